@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"os/user"
+	"strconv"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -25,11 +29,39 @@ func getAPIUrl(path string, values url.Values) string {
 	}
 }
 
-func postListen(port string, service string) (string, error) {
-	resp, err := http.PostForm(getAPIUrl("/expose/listen", nil), url.Values{
+type listenOptions struct {
+	proxyProtocol string
+	passClient    bool
+	httpLog       bool
+	maxConns      int
+	bandwidthIn   int64
+	bandwidthOut  int64
+}
+
+func postListen(port string, service string, opts *listenOptions) (string, error) {
+	values := url.Values{
 		"service": []string{service},
 		"port":    []string{port},
-	})
+	}
+	if opts.proxyProtocol != "" {
+		values.Set("proxyProtocol", opts.proxyProtocol)
+	}
+	if opts.passClient {
+		values.Set("passClient", "true")
+	}
+	if opts.httpLog {
+		values.Set("httpLog", "true")
+	}
+	if opts.maxConns > 0 {
+		values.Set("maxConns", strconv.Itoa(opts.maxConns))
+	}
+	if opts.bandwidthIn > 0 {
+		values.Set("bandwidthIn", strconv.FormatInt(opts.bandwidthIn, 10))
+	}
+	if opts.bandwidthOut > 0 {
+		values.Set("bandwidthOut", strconv.FormatInt(opts.bandwidthOut, 10))
+	}
+	resp, err := apiClient.PostForm(getAPIUrl("/expose/listen", nil), values)
 	if err != nil {
 		return "", err
 	}
@@ -45,23 +77,30 @@ func postListen(port string, service string) (string, error) {
 }
 
 func listenCommand() *cobra.Command {
+	var opts listenOptions
 	cmd := &cobra.Command{
 		Use:   "listen port service",
 		Short: "Listen service",
 		Args:  cobra.ExactArgs(2),
 		Run: func(_ *cobra.Command, args []string) {
-			token, err := postListen(args[0], args[1])
+			token, err := postListen(args[0], args[1], &opts)
 			if err != nil {
 				fatal("listen service:", err)
 			}
 			fmt.Println(token)
 		},
 	}
+	cmd.Flags().StringVar(&opts.proxyProtocol, "accept-proxy-protocol", "", "strip PROXY protocol header sent by the load balancer: v1, v2 or any")
+	cmd.Flags().BoolVar(&opts.passClient, "pass-client", false, "send the client address from the PROXY protocol header to agents")
+	cmd.Flags().IntVar(&opts.maxConns, "max-conns", 0, "max concurrent connections to the service, limited by expose")
+	cmd.Flags().Int64Var(&opts.bandwidthIn, "bandwidth-in", 0, "bytes per second from clients to agents, limited by expose")
+	cmd.Flags().Int64Var(&opts.bandwidthOut, "bandwidth-out", 0, "bytes per second from agents to clients, limited by expose")
+	cmd.Flags().BoolVar(&opts.httpLog, "http-log", false, "log each HTTP/1.x request to the service on expose")
 	return cmd
 }
 
 func getPort(port string) ([]string, error) {
-	resp, err := http.Get(getAPIUrl("/expose/port", url.Values{
+	resp, err := apiClient.Get(getAPIUrl("/expose/port", url.Values{
 		"port": []string{port},
 	}))
 	if err != nil {
@@ -107,9 +146,23 @@ func portCommand() *cobra.Command {
 	return cmd
 }
 
-func postRevoke(token string) (string, error) {
-	resp, err := http.PostForm(getAPIUrl("/expose/revoke", nil), url.Values{
-		"token": []string{token},
+// currentUser 返回 user@host，用于告知被回收的 agent
+func currentUser() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		name += "@" + host
+	}
+	return name
+}
+
+func postRevoke(token string, reason string) (string, error) {
+	resp, err := apiClient.PostForm(getAPIUrl("/expose/revoke", nil), url.Values{
+		"token":  []string{token},
+		"reason": []string{reason},
+		"by":     []string{currentUser()},
 	})
 	if err != nil {
 		return "", err
@@ -126,16 +179,49 @@ func postRevoke(token string) (string, error) {
 }
 
 func revokeCommand() *cobra.Command {
+	var reason string
 	cmd := &cobra.Command{
 		Use:   "revoke token",
 		Short: "Revoke token",
 		Args:  cobra.ExactArgs(1),
 		Run: func(_ *cobra.Command, args []string) {
-			_, err := postRevoke(args[0])
+			_, err := postRevoke(args[0], reason)
 			if err != nil {
 				fatal("revoke token:", err)
 			}
 		},
 	}
+	cmd.Flags().StringVar(&reason, "reason", "", "reason sent to linked agents")
 	return cmd
 }
+
+type servicePort struct {
+	Name     string `json:"name"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+type serviceInfo struct {
+	Name      string        `json:"name"`
+	Namespace string        `json:"namespace"`
+	ClusterIP string        `json:"clusterIP"`
+	Ports     []servicePort `json:"ports"`
+}
+
+func getServices() ([]serviceInfo, error) {
+	resp, err := apiClient.Get(getAPIUrl("/expose/services", nil))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respData, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("API Error: %d %s", resp.StatusCode, string(bytes.TrimSpace(respData)))
+	}
+	var services []serviceInfo
+	err = json.NewDecoder(resp.Body).Decode(&services)
+	if err != nil {
+		return nil, err
+	}
+	return services, nil
+}
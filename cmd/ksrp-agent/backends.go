@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	balanceRoundRobin = "round-robin"
+	balanceLeastConn  = "least-conn"
+	balanceFailover   = "failover"
+)
+
+type backend struct {
+	pool   *localPool
+	active atomic.Int64
+}
+
+// backendGroup 在多个后端之间选择连接，熔断的后端会被跳过，连接失败时尝试下一个后端
+type backendGroup struct {
+	backends []*backend
+	balance  string
+	next     atomic.Uint64
+}
+
+// parseBackends 解析逗号分隔的后端地址
+func parseBackends(s string) ([]string, error) {
+	var addresses []string
+	for _, address := range strings.Split(s, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		_, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backend %q: %w", address, err)
+		}
+		addresses = append(addresses, address)
+	}
+	if len(addresses) == 0 {
+		return nil, errors.New("no backend")
+	}
+	return addresses, nil
+}
+
+func newBackendGroup(addresses []string, balance string, opts *localPoolOptions) (*backendGroup, error) {
+	switch balance {
+	case balanceRoundRobin, balanceLeastConn, balanceFailover:
+	default:
+		return nil, fmt.Errorf("unsupported balance %q", balance)
+	}
+	g := &backendGroup{
+		balance: balance,
+	}
+	for _, address := range addresses {
+		pool, err := newLocalPool(address, opts)
+		if err != nil {
+			return nil, err
+		}
+		g.backends = append(g.backends, &backend{pool: pool})
+	}
+	return g, nil
+}
+
+// start 开始预连接，failover 只预连接第一个后端，其他后端在第一次被使用时才开始预连接
+func (g *backendGroup) start() {
+	for i, b := range g.backends {
+		if g.balance == balanceFailover && i > 0 {
+			break
+		}
+		b.pool.start()
+	}
+}
+
+// order 返回本次尝试后端的顺序
+func (g *backendGroup) order() []*backend {
+	if len(g.backends) == 1 {
+		return g.backends
+	}
+	switch g.balance {
+	case balanceRoundRobin:
+		i := int(g.next.Add(1)-1) % len(g.backends)
+		return append(g.backends[i:len(g.backends):len(g.backends)], g.backends[:i]...)
+	case balanceLeastConn:
+		backends := slices.Clone(g.backends)
+		slices.SortStableFunc(backends, func(a *backend, b *backend) int {
+			return int(a.active.Load() - b.active.Load())
+		})
+		return backends
+	default:
+		// failover 按照配置的顺序使用第一个可用的后端
+		return g.backends
+	}
+}
+
+// get 返回一个后端连接，流结束后需要调用 done
+func (g *backendGroup) get() (net.Conn, func(), error) {
+	var errs []error
+	for _, b := range g.order() {
+		b.pool.start()
+		conn, err := b.pool.get()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", b.pool.address, err))
+			continue
+		}
+		b.active.Add(1)
+		return conn, func() { b.active.Add(-1) }, nil
+	}
+	return nil, nil, errors.Join(errs...)
+}
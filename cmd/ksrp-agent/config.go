@@ -90,6 +90,8 @@ func saveConfigCommand() *cobra.Command {
 				"api":     apiAddress,
 				"api_key": apiKey,
 				"link":    linkAddress,
+				"proxy":   proxyAddress,
+				"jump":    jumpAddress,
 			})
 			if err != nil {
 				fatal(err)
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTTL = 5
+)
+
+type dnsOptions struct {
+	keepaliveOptions
+	listen  string
+	domain  string
+	ipRange string
+	refresh time.Duration
+}
+
+// serviceForward 是一个 Service 在本地的 IP 以及每个端口的监听
+type serviceForward struct {
+	ports []servicePort
+	ip    netip.Addr
+	lns   []net.Listener
+}
+
+func (f *serviceForward) close() {
+	for _, ln := range f.lns {
+		ln.Close()
+	}
+}
+
+// dnsResolver 把集群 Service 名字解析为本地回环地址，并在该地址上监听 Service 端口转发到 expose
+type dnsResolver struct {
+	session  *exposeSession
+	domain   string
+	prefix   netip.Prefix
+	next     netip.Addr
+	lock     sync.RWMutex
+	names    map[string]netip.Addr
+	services map[string]*serviceForward
+}
+
+func (r *dnsResolver) allocIP() (netip.Addr, error) {
+	ip := r.next.Next()
+	if !ip.IsValid() || !r.prefix.Contains(ip) {
+		return netip.Addr{}, fmt.Errorf("ip range %s exhausted", r.prefix)
+	}
+	r.next = ip
+	return ip, nil
+}
+
+// serviceNames 返回 Service 可以被解析的名字
+func (r *dnsResolver) serviceNames(svc *serviceInfo) []string {
+	base := strings.ToLower(svc.Name + "." + svc.Namespace)
+	return []string{
+		base + ".",
+		base + ".svc.",
+		base + ".svc." + r.domain + ".",
+	}
+}
+
+// listenService 监听 Service 的 TCP 端口，返回无法监听的端口和最后一个错误
+func (r *dnsResolver) listenService(svc *serviceInfo, fwd *serviceForward) ([]string, error) {
+	target := strings.ToLower(svc.Name + "." + svc.Namespace + ".svc." + r.domain)
+	var (
+		failed  []string
+		lastErr error
+	)
+	for _, port := range svc.Ports {
+		if port.Protocol != "" && port.Protocol != "TCP" {
+			continue
+		}
+		address := net.JoinHostPort(fwd.ip.String(), strconv.Itoa(port.Port))
+		ln, err := net.Listen("tcp", address)
+		if err != nil {
+			failed = append(failed, strconv.Itoa(port.Port))
+			lastErr = err
+			continue
+		}
+		fwd.lns = append(fwd.lns, ln)
+
+		targetAddress := net.JoinHostPort(target, strconv.Itoa(port.Port))
+		go serveListener(ln, func(conn net.Conn) {
+			handleForwardConn(r.session, conn, targetAddress)
+		})
+	}
+	return failed, lastErr
+}
+
+// sync 根据 Service 列表增删本地监听
+func (r *dnsResolver) sync(services []serviceInfo) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	seen := make(map[string]bool, len(services))
+	for i := range services {
+		svc := &services[i]
+		key := svc.Namespace + "/" + svc.Name
+		seen[key] = true
+
+		fwd := r.services[key]
+		if fwd != nil && slices.Equal(fwd.ports, svc.Ports) {
+			continue
+		}
+		if fwd != nil {
+			// 端口发生变化，保留 IP 重新监听
+			fwd.close()
+			fwd = &serviceForward{ip: fwd.ip}
+		} else {
+			ip, err := r.allocIP()
+			if err != nil {
+				slog.Warn("alloc service ip", "service", key, "err", err)
+				continue
+			}
+			fwd = &serviceForward{ip: ip}
+			for _, name := range r.serviceNames(svc) {
+				r.names[name] = ip
+			}
+		}
+		fwd.ports = svc.Ports
+		failed, err := r.listenService(svc, fwd)
+		if len(failed) != 0 {
+			// 解析到的地址上没有监听，连接会被拒绝
+			msg := "service ports are unreachable"
+			if errors.Is(err, os.ErrPermission) {
+				msg += ", ports below 1024 need root or CAP_NET_BIND_SERVICE"
+			}
+			slog.Error(msg, "service", key, "ports", strings.Join(failed, ","), "err", err)
+		}
+		r.services[key] = fwd
+
+		slog.Info("forward service", "service", key, "ip", fwd.ip.String(), "ports", len(fwd.lns))
+	}
+
+	for key, fwd := range r.services {
+		if seen[key] {
+			continue
+		}
+		slog.Info("remove service", "service", key)
+		fwd.close()
+		for name, ip := range r.names {
+			if ip == fwd.ip {
+				delete(r.names, name)
+			}
+		}
+		delete(r.services, key)
+	}
+}
+
+func (r *dnsResolver) lookup(name string) (netip.Addr, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ip, ok := r.names[strings.ToLower(name)]
+	return ip, ok
+}
+
+// inZone 判断名字是否属于集群域名
+func (r *dnsResolver) inZone(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, "."+r.domain+".") || strings.HasSuffix(name, ".svc.")
+}
+
+func (r *dnsResolver) handleQuery(req []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(req)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		Authoritative:      true,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: false,
+	}
+	ip, ok := r.lookup(q.Name.String())
+	if !ok {
+		if r.inZone(q.Name.String()) {
+			hdr.RCode = dnsmessage.RCodeNameError
+		} else {
+			hdr.RCode = dnsmessage.RCodeRefused
+		}
+	}
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), hdr)
+	b.EnableCompression()
+	err = b.StartQuestions()
+	if err == nil {
+		err = b.Question(q)
+	}
+	if err == nil {
+		err = b.StartAnswers()
+	}
+	// 只回答 A 记录，其他类型返回空结果
+	if err == nil && ok && q.Type == dnsmessage.TypeA && q.Class == dnsmessage.ClassINET {
+		err = b.AResource(dnsmessage.ResourceHeader{
+			Name:  q.Name,
+			Class: dnsmessage.ClassINET,
+			TTL:   dnsTTL,
+		}, dnsmessage.AResource{A: ip.As4()})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+func (r *dnsResolver) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			slog.Warn("read dns query", "err", err)
+			return
+		}
+		resp, err := r.handleQuery(buf[:n])
+		if err != nil {
+			slog.Debug("handle dns query", "addr", addr.String(), "err", err)
+			continue
+		}
+		_, err = pc.WriteTo(resp, addr)
+		if err != nil {
+			slog.Debug("write dns response", "addr", addr.String(), "err", err)
+		}
+	}
+}
+
+func (r *dnsResolver) refreshLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		services, err := getServices()
+		if err != nil {
+			slog.Warn("get services", "err", err)
+			continue
+		}
+		r.sync(services)
+	}
+}
+
+func (r *dnsResolver) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, fwd := range r.services {
+		fwd.close()
+	}
+}
+
+func dnsMain(opts *dnsOptions) {
+	prefix, err := netip.ParsePrefix(opts.ipRange)
+	if err != nil || !prefix.Addr().Is4() || !prefix.Addr().IsLoopback() {
+		fatal("invalid ip range:", opts.ipRange)
+	}
+	prefix = prefix.Masked()
+
+	services, err := getServices()
+	if err != nil {
+		fatal("get services:", err)
+	}
+
+	session := newExposeSession(&opts.keepaliveOptions)
+	defer session.close()
+
+	r := &dnsResolver{
+		session:  session,
+		domain:   strings.ToLower(strings.Trim(opts.domain, ".")),
+		prefix:   prefix,
+		next:     prefix.Addr(),
+		names:    make(map[string]netip.Addr),
+		services: make(map[string]*serviceForward),
+	}
+	r.sync(services)
+	defer r.close()
+
+	pc, err := net.ListenPacket("udp", opts.listen)
+	if err != nil {
+		fatal("listen dns:", err)
+	}
+	defer pc.Close()
+
+	slog.Info("serve dns", "listen", pc.LocalAddr().String(), "domain", r.domain)
+
+	go r.serveUDP(pc)
+	if opts.refresh > 0 {
+		go r.refreshLoop(opts.refresh)
+	}
+
+	waitSignal()
+}
+
+func dnsCommand() *cobra.Command {
+	var opts dnsOptions
+	cmd := &cobra.Command{
+		Use:   "dns",
+		Short: "Resolve cluster Service names to local addresses forwarded through expose",
+		Long: `Resolve cluster Service names to loopback addresses and forward each Service port through expose.
+
+Point the resolver of the cluster domain to the listen address, e.g. /etc/resolver/cluster.local on macOS.
+On macOS, addresses other than 127.0.0.1 must be added as lo0 aliases first.
+Service ports are listened as is, so ports below 1024 (e.g. 80 and 443) need root or CAP_NET_BIND_SERVICE,
+otherwise they are reported as unreachable and connections to them are refused.`,
+		Args: cobra.NoArgs,
+		Run: func(_ *cobra.Command, _ []string) {
+			dnsMain(&opts)
+		},
+	}
+	cmd.Flags().StringVar(&opts.listen, "listen", "127.0.0.1:5353", "dns listen address")
+	cmd.Flags().StringVar(&opts.domain, "domain", "cluster.local", "cluster domain")
+	cmd.Flags().StringVar(&opts.ipRange, "ip-range", "127.77.0.0/16", "loopback addresses allocated to services")
+	cmd.Flags().DurationVar(&opts.refresh, "refresh", 30*time.Second, "service list refresh interval, 0 to disable")
+	opts.addFlags(cmd.Flags())
+	return cmd
+}
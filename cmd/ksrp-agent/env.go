@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+type envVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type serviceEnv struct {
+	Env     []envVar `json:"env"`
+	Skipped []string `json:"skipped"`
+}
+
+func getServiceEnv(service string, container string) (*serviceEnv, error) {
+	values := url.Values{
+		"service": []string{service},
+	}
+	if container != "" {
+		values.Set("container", container)
+	}
+	resp, err := apiClient.Get(getAPIUrl("/expose/env", values))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respData, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("API Error: %d %s", resp.StatusCode, string(bytes.TrimSpace(respData)))
+	}
+	var env serviceEnv
+	err = json.NewDecoder(resp.Body).Decode(&env)
+	if err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
+// validEnvName 判断变量名是否可以写到 shell 中，变量名可能来自带前缀的 envFrom，不检查时可以注入命令
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if c != '_' && !(c >= 'A' && c <= 'Z') && !(c >= 'a' && c <= 'z') && (i == 0 || !(c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// skipInvalidNames 把不能写到 shell 中的变量移到 Skipped
+func (env *serviceEnv) skipInvalidNames() {
+	valid := env.Env[:0]
+	for _, ev := range env.Env {
+		if validEnvName(ev.Name) {
+			valid = append(valid, ev)
+		} else {
+			env.Skipped = append(env.Skipped, fmt.Sprintf("%q: invalid variable name", ev.Name))
+		}
+	}
+	env.Env = valid
+}
+
+var dotenvEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "$", `\$`)
+
+func writeEnv(w io.Writer, env []envVar, format string) error {
+	switch format {
+	case "dotenv":
+		for _, ev := range env {
+			fmt.Fprintf(w, "%s=\"%s\"\n", ev.Name, dotenvEscaper.Replace(ev.Value))
+		}
+	case "shell":
+		for _, ev := range env {
+			fmt.Fprintf(w, "export %s='%s'\n", ev.Name, strings.ReplaceAll(ev.Value, "'", `'\''`))
+		}
+	case "json":
+		vars := make(map[string]string, len(env))
+		for _, ev := range env {
+			vars[ev.Name] = ev.Value
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(vars)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	return nil
+}
+
+func envCommand() *cobra.Command {
+	var (
+		format    string
+		container string
+	)
+	cmd := &cobra.Command{
+		Use:   "env service",
+		Short: "Print environment variables of the workload selected by the service",
+		Long: `Print environment variables of the workload originally selected by the service, resolving env and envFrom
+from ConfigMaps, and from Secrets when allowed by expose. Variables whose names are not valid shell names are
+skipped in the dotenv and shell formats.
+
+  eval "$(ksrp-agent env my-service --format shell)"`,
+		Args: cobra.ExactArgs(1),
+		Run: func(_ *cobra.Command, args []string) {
+			env, err := getServiceEnv(args[0], container)
+			if err != nil {
+				fatal("get service env:", err)
+			}
+			if format != "json" {
+				env.skipInvalidNames()
+			}
+			// 无法解析的变量输出到 stderr，不影响 eval 或重定向
+			for _, s := range env.Skipped {
+				fmt.Fprintln(os.Stderr, "skipped:", s)
+			}
+			err = writeEnv(os.Stdout, env.Env, format)
+			if err != nil {
+				fatal("write env:", err)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&format, "format", "dotenv", "output format: dotenv, shell or json")
+	cmd.Flags().StringVar(&container, "container", "", "container name, defaults to the first container")
+	return cmd
+}
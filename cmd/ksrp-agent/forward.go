@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vizee/ksrp/ioutil"
+)
+
+type forwardOptions struct {
+	keepaliveOptions
+	bind string
+}
+
+func handleForwardConn(session *exposeSession, conn net.Conn, target string) {
+	defer conn.Close()
+
+	st, err := session.dial(target)
+	if err != nil {
+		slog.Error("dial target", "target", target, "err", err)
+		return
+	}
+	defer st.Close()
+
+	slog.Debug("copy forward traffic", "conn", conn.RemoteAddr().String(), "target", target)
+
+	err = ioutil.DualCopy(conn, st)
+	if err != nil && err != io.EOF {
+		slog.Error("copy forward traffic", "conn", conn.RemoteAddr().String(), "target", target, "err", err)
+	}
+}
+
+// serveListener 接受连接并在新的协程中处理，直到 ln 被关闭
+func serveListener(ln net.Listener, handle func(net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				time.Sleep(time.Second)
+				continue
+			}
+			return
+		}
+		go handle(conn)
+	}
+}
+
+func forwardMain(localPort string, target string, opts *forwardOptions) {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		fatal("invalid target:", err)
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(opts.bind, localPort))
+	if err != nil {
+		fatal("listen:", err)
+	}
+	defer ln.Close()
+
+	session := newExposeSession(&opts.keepaliveOptions)
+	defer session.close()
+
+	slog.Info("forward", "local", ln.Addr().String(), "target", target)
+
+	go serveListener(ln, func(conn net.Conn) {
+		handleForwardConn(session, conn, target)
+	})
+
+	waitSignal()
+}
+
+func forwardCommand() *cobra.Command {
+	var opts forwardOptions
+	cmd := &cobra.Command{
+		Use:   "forward local-port cluster-host:port",
+		Short: "Forward local port to cluster address through expose",
+		Args:  cobra.ExactArgs(2),
+		Run: func(_ *cobra.Command, args []string) {
+			forwardMain(args[0], args[1], &opts)
+		},
+	}
+	cmd.Flags().StringVar(&opts.bind, "bind", "127.0.0.1", "local bind address")
+	opts.addFlags(cmd.Flags())
+	return cmd
+}
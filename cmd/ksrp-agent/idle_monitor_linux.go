@@ -0,0 +1,107 @@
+package main
+
+import (
+	"cmp"
+	"log/slog"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// idleMonitor 用一个 epoll 监视所有池中的空闲连接，连接可读说明对端关闭或者提前发送了数据
+type idleMonitor struct {
+	epfd  int
+	lock  sync.Mutex
+	conns map[int32]*localConn
+}
+
+func newIdleMonitor() (*idleMonitor, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	m := &idleMonitor{
+		epfd:  epfd,
+		conns: make(map[int32]*localConn),
+	}
+	go m.run()
+	return m, nil
+}
+
+func (m *idleMonitor) control(c *localConn, f func(fd int32) error) error {
+	rawConn, err := c.conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	var innerErr error
+	err = rawConn.Control(func(fd uintptr) {
+		m.lock.Lock()
+		innerErr = f(int32(fd))
+		m.lock.Unlock()
+	})
+	return cmp.Or(err, innerErr)
+}
+
+func (m *idleMonitor) arm(op int, fd int32) error {
+	// ONESHOT 避免在处理事件前重复触发
+	return syscall.EpollCtl(m.epfd, op, int(fd), &syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT,
+		Fd:     fd,
+	})
+}
+
+func (m *idleMonitor) add(c *localConn) error {
+	return m.control(c, func(fd int32) error {
+		err := m.arm(syscall.EPOLL_CTL_ADD, fd)
+		if err != nil {
+			return err
+		}
+		m.conns[fd] = c
+		return nil
+	})
+}
+
+// remove 停止监视连接，必须在关闭连接之前调用
+func (m *idleMonitor) remove(c *localConn) {
+	m.control(c, func(fd int32) error {
+		if m.conns[fd] == c {
+			delete(m.conns, fd)
+			return syscall.EpollCtl(m.epfd, syscall.EPOLL_CTL_DEL, int(fd), nil)
+		}
+		return nil
+	})
+}
+
+func (m *idleMonitor) run() {
+	events := make([]syscall.EpollEvent, 64)
+	for {
+		n, err := syscall.EpollWait(m.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			slog.Error("epoll wait", "err", err)
+			return
+		}
+		for _, ev := range events[:n] {
+			m.lock.Lock()
+			c := m.conns[ev.Fd]
+			m.lock.Unlock()
+			if c == nil {
+				continue
+			}
+			err := peekTcpRead(c.conn)
+			if err == syscall.EAGAIN {
+				// 没有数据，重新监视
+				m.control(c, func(fd int32) error {
+					if m.conns[fd] == c {
+						return m.arm(syscall.EPOLL_CTL_MOD, fd)
+					}
+					return nil
+				})
+				continue
+			}
+			c.pool.dropConn(c, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+//go:build unix && !linux
+
+package main
+
+import (
+	"sync"
+	"syscall"
+	"time"
+)
+
+const idleCheckInterval = time.Second
+
+// idleMonitor 用一个 goroutine 定期检查所有池中的空闲连接，连接可读说明对端关闭或者提前发送了数据
+type idleMonitor struct {
+	lock  sync.Mutex
+	conns map[*localConn]struct{}
+}
+
+func newIdleMonitor() (*idleMonitor, error) {
+	m := &idleMonitor{
+		conns: make(map[*localConn]struct{}),
+	}
+	go m.run()
+	return m, nil
+}
+
+func (m *idleMonitor) add(c *localConn) error {
+	m.lock.Lock()
+	m.conns[c] = struct{}{}
+	m.lock.Unlock()
+	return nil
+}
+
+// remove 停止监视连接，必须在关闭连接之前调用
+func (m *idleMonitor) remove(c *localConn) {
+	m.lock.Lock()
+	delete(m.conns, c)
+	m.lock.Unlock()
+}
+
+func (m *idleMonitor) run() {
+	var conns []*localConn
+	for range time.Tick(idleCheckInterval) {
+		conns = conns[:0]
+		m.lock.Lock()
+		for c := range m.conns {
+			conns = append(conns, c)
+		}
+		m.lock.Unlock()
+		for _, c := range conns {
+			err := peekTcpRead(c.conn)
+			if err != syscall.EAGAIN {
+				c.pool.dropConn(c, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// jumpKeepaliveInterval 是向跳板机发送 keepalive 请求的间隔，没有响应时断开并在下次使用时重连
+	jumpKeepaliveInterval = 15 * time.Second
+	jumpKeepaliveTimeout  = 10 * time.Second
+)
+
+var (
+	// jumpAddress 是 --jump 指定的 SSH 跳板机，设置后 API 和 link 都通过跳板机连接
+	jumpAddress string
+	// jumpKey 是登录跳板机的私钥文件，为空时使用 ssh-agent 和 ~/.ssh 下的默认私钥
+	jumpKey string
+	// jumpKnownHosts 是校验跳板机主机密钥的 known_hosts 文件，为空时使用 ~/.ssh/known_hosts
+	jumpKnownHosts string
+)
+
+// parseJumpAddress 解析 ssh://user@host:port 或者 user@host，返回用户名和 host:port
+func parseJumpAddress(address string) (string, string, error) {
+	if !strings.Contains(address, "://") {
+		address = "ssh://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" {
+		return "", "", fmt.Errorf("invalid jump host %q", address)
+	}
+	username := u.User.Username()
+	if username == "" {
+		cu, err := user.Current()
+		if err != nil {
+			return "", "", err
+		}
+		username = cu.Username
+	}
+	return username, net.JoinHostPort(u.Hostname(), cmp.Or(u.Port(), "22")), nil
+}
+
+func loadSigner(fname string) (ssh.Signer, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// jumpSigners 返回 ssh-agent 中的密钥以及私钥文件，返回的函数用于在握手后断开 ssh-agent
+func jumpSigners() ([]ssh.Signer, func(), error) {
+	var (
+		signers    []ssh.Signer
+		closeAgent = func() {}
+	)
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err == nil {
+			closeAgent = func() { conn.Close() }
+			ss, err := agent.NewClient(conn).Signers()
+			if err != nil {
+				slog.Warn("list ssh-agent keys", "err", err)
+			}
+			signers = append(signers, ss...)
+		} else {
+			slog.Warn("connect ssh-agent", "err", err)
+		}
+	}
+
+	if jumpKey != "" {
+		signer, err := loadSigner(jumpKey)
+		if err != nil {
+			closeAgent()
+			return nil, nil, fmt.Errorf("load jump key: %w", err)
+		}
+		return append(signers, signer), closeAgent, nil
+	}
+	home, _ := os.UserHomeDir()
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		fname := filepath.Join(home, ".ssh", name)
+		signer, err := loadSigner(fname)
+		if err != nil {
+			// 不存在或者需要密码的私钥直接跳过，需要密码的私钥应该添加到 ssh-agent
+			if !os.IsNotExist(err) {
+				slog.Debug("skip ssh key", "file", fname, "err", err)
+			}
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	return signers, closeAgent, nil
+}
+
+// knownHostKeyAlgorithms 返回 known_hosts 中 address 的主机密钥算法，避免服务端优先使用没有记录的算法导致校验失败
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback, address string) []string {
+	probe, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(callback(address, &net.TCPAddr{}, probe), &keyErr) {
+		return nil
+	}
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		switch t := known.Key.Type(); t {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, t)
+		}
+	}
+	return algorithms
+}
+
+func jumpHostKeyCallback() (ssh.HostKeyCallback, error) {
+	fname := jumpKnownHosts
+	if fname == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		fname = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(fname)
+	if err != nil {
+		return nil, fmt.Errorf("load known hosts: %w", err)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			return fmt.Errorf("jump host %s is not in %s, add it with ssh-keyscan or by logging in with ssh once", hostname, fname)
+		}
+		return err
+	}, nil
+}
+
+// jumpHost 维护到跳板机的 SSH 连接，断开后在下次使用时重连
+type jumpHost struct {
+	lock   sync.Mutex
+	client *ssh.Client
+}
+
+var jump jumpHost
+
+func (j *jumpHost) connect() (*ssh.Client, error) {
+	username, address, err := parseJumpAddress(jumpAddress)
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := jumpHostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+	signers, closeAgent, err := jumpSigners()
+	if err != nil {
+		return nil, err
+	}
+	defer closeAgent()
+	if len(signers) == 0 {
+		return nil, errors.New("no ssh keys for jump host, use ssh-agent or --jump-key")
+	}
+
+	// 跳板机本身可以通过代理连接
+	conn, err := dialDirect(&url.URL{Scheme: "ssh", Host: address})
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, &ssh.ClientConfig{
+		User:              username,
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: knownHostKeyAlgorithms(hostKeyCallback, address),
+	})
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	slog.Debug("jump host connected", "address", address, "user", username)
+
+	client := ssh.NewClient(c, chans, reqs)
+	done := make(chan struct{})
+	go j.keepalive(client, done)
+	go func() {
+		err := client.Wait()
+		close(done)
+		slog.Debug("jump host disconnected", "address", address, "err", err)
+		j.lock.Lock()
+		if j.client == client {
+			j.client = nil
+		}
+		j.lock.Unlock()
+	}()
+	return client, nil
+}
+
+// keepalive 定期发送 keepalive 请求，跳板机的 TCP 连接静默断开时关闭 client
+func (j *jumpHost) keepalive(client *ssh.Client, done chan struct{}) {
+	ticker := time.NewTicker(jumpKeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+		var err error
+		select {
+		case err = <-replied:
+		case <-time.After(jumpKeepaliveTimeout):
+			err = errors.New("keepalive timeout")
+		case <-done:
+			return
+		}
+		if err != nil {
+			slog.Warn("jump host keepalive", "err", err)
+			j.drop(client)
+			return
+		}
+	}
+}
+
+// drop 关闭 client，下次使用时重新连接
+func (j *jumpHost) drop(client *ssh.Client) {
+	j.lock.Lock()
+	if j.client == client {
+		j.client = nil
+	}
+	j.lock.Unlock()
+	client.Close()
+}
+
+func (j *jumpHost) getClient() (*ssh.Client, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.client == nil {
+		client, err := j.connect()
+		if err != nil {
+			return nil, fmt.Errorf("connect jump host: %w", err)
+		}
+		j.client = client
+	}
+	return j.client, nil
+}
+
+// dial 通过跳板机连接 address，address 由跳板机解析
+func (j *jumpHost) dial(address string) (net.Conn, error) {
+	client, err := j.getClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	conn, err := client.DialContext(ctx, "tcp", address)
+	if err != nil && ctx.Err() != nil {
+		// 跳板机没有响应，可能连接已经断开
+		j.drop(client)
+	}
+	return conn, err
+}
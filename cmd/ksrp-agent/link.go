@@ -1,96 +1,412 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"os"
-	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/vizee/ksrp/ioutil"
 	"github.com/vizee/ksrp/proto"
+	"github.com/vizee/ksrp/proxyproto"
 	"github.com/vizee/mstp"
 )
 
-func shakeHandsWithExpose(conn net.Conn, token string) error {
+const (
+	// exitRevoked 是 token 被回收时的退出码
+	exitRevoked = 3
+)
+
+var (
+	errLinkClosed = errors.New("link closed")
+)
+
+func shakeHandsWithExpose(conn net.Conn, token string, caps proto.Capabilities) (*proto.Hello, error) {
+	local := &proto.Hello{
+		Version:       proto.ProtocolVersion,
+		BinaryVersion: proto.BinaryVersion,
+		Capabilities:  caps,
+	}
+
 	conn.SetWriteDeadline(time.Now().Add(time.Second))
-	err := proto.WriteMessage(conn, proto.CmdShakeHands, token)
+	_, err := conn.Write([]byte{proto.FrameMagic})
+	if err == nil {
+		hello := *local
+		if token != "" {
+			hello.Token = token
+		} else {
+			hello.APIKey = apiKey
+		}
+		err = proto.WriteFrame(conn, &hello)
+	}
 	conn.SetWriteDeadline(time.Time{})
 	if err != nil {
-		return err
+		return nil, err
 	}
+
 	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
-	cmd, msg, err := proto.ReadMessage(conn)
+	msg, err := proto.ReadFrame(conn)
 	conn.SetReadDeadline(time.Time{})
 	if err != nil {
-		return err
+		if err == io.EOF || errors.Is(err, syscall.ECONNRESET) {
+			// 旧版本 expose 不认识 v2 帧，会直接关闭连接，未读取的数据会导致连接被重置
+			return nil, fmt.Errorf("expose closed connection during hello, it may be outdated: %w", err)
+		}
+		return nil, err
 	}
-	switch cmd {
-	case proto.CmdShakeHandsOk:
-		return nil
-	case proto.CmdError:
-		return fmt.Errorf("error: %s", msg)
+	switch msg := msg.(type) {
+	case *proto.HelloOk:
+		return proto.Negotiate(local, &msg.Hello)
+	case *proto.Error:
+		return nil, msg
 	default:
-		return fmt.Errorf("unexpected cmd: %x", cmd)
+		return nil, fmt.Errorf("unexpected message: %d", msg.Type())
+	}
+}
+
+// dialExpose 连接 expose 并握手，token 为空时使用 API key 建立会话
+func dialExpose(token string, caps proto.Capabilities) (net.Conn, *proto.Hello, error) {
+	conn, err := dialLink(linkAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+	hello, err := shakeHandsWithExpose(conn, token, caps)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, hello, nil
+}
+
+type keepaliveOptions struct {
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func (o *keepaliveOptions) addFlags(fs *pflag.FlagSet) {
+	fs.DurationVar(&o.interval, "keepalive-interval", 15*time.Second, "keepalive ping interval, 0 to disable")
+	fs.DurationVar(&o.timeout, "keepalive-timeout", 45*time.Second, "disconnect if expose does not respond within timeout")
+}
+
+// capabilities 返回包含 keepalive 在内的能力集合
+func (o *keepaliveOptions) capabilities(names ...string) proto.Capabilities {
+	if o.interval > 0 {
+		names = append(names, proto.CapKeepalive)
 	}
+	return proto.NewCapabilities(names...)
 }
 
 type linkOptions struct {
-	backendConns int
+	keepaliveOptions
+	localPoolOptions
+	maxRestarts  int
+	readyTimeout time.Duration
+	revokeOnExit bool
+	// proxyProtocol 不为 0 时在后端连接上写入 PROXY 协议头
+	proxyProtocol int
+	compress      bool
+	balance       string
 }
 
-func linkMain(token string, backend string, opts *linkOptions) {
-	conn, err := net.Dial("tcp", linkAddress)
+// serveBackendStream 把 expose 打开的流转发到后端，metadata 表示流上的第一帧是 StreamMetadata
+func serveBackendStream(s *mstp.Stream, backends *backendGroup, metadata bool, proxyProtocol int) {
+	defer s.Close()
+
+	header := &proxyproto.Header{}
+	if metadata {
+		msg, err := proto.ReadFrame(s)
+		if err != nil {
+			slog.Error("read stream metadata", "stream", fmt.Sprintf("%p", s), "err", err)
+			return
+		}
+		md, ok := msg.(*proto.StreamMetadata)
+		if !ok {
+			slog.Error("unexpected stream message", "stream", fmt.Sprintf("%p", s), "type", msg.Type())
+			return
+		}
+		slog.Debug("stream metadata", "stream", fmt.Sprintf("%p", s), "client", md.ClientAddr, "dest", md.DestAddr)
+		header = proxyproto.NewHeader(md.ClientAddr, md.DestAddr)
+	}
+
+	bc, done, err := backends.get()
 	if err != nil {
-		slog.Error("dial link", "err", err)
-		os.Exit(1)
+		slog.Error("get backend", "err", err)
+		return
+	}
+	defer done()
+	defer bc.Close()
+
+	if proxyProtocol != 0 {
+		// 没有元数据时写入来源未知的协议头，后端仍然可以正常解析
+		err = header.Write(bc, proxyProtocol)
+		if err != nil {
+			slog.Error("write proxy protocol header", "backend", bc.RemoteAddr().String(), "err", err)
+			return
+		}
 	}
-	err = shakeHandsWithExpose(conn, token)
+
+	slog.Debug("copy traffic", "stream", fmt.Sprintf("%p", s), "backend", bc.RemoteAddr().String())
+
+	err = ioutil.DualCopy(s, bc)
+	if err != nil && err != io.EOF {
+		slog.Error("copy traffic", "stream", fmt.Sprintf("%p", s), "backend", bc.RemoteAddr().String(), "err", err)
+	}
+}
+
+// serveControl 打开控制流并保持 keepalive，返回时控制流已经不可用。收到回收通知时返回 *proto.Revoked
+func serveControl(msc *mstp.Conn, hello *proto.Hello, opts *keepaliveOptions) error {
+	s, err := msc.NewStream()
 	if err != nil {
-		slog.Error("shake hands", "err", err)
-		os.Exit(1)
+		return err
+	}
+	cs := proto.NewControlStream(s)
+	err = cs.Send(&proto.OpenStream{Kind: proto.StreamControl})
+	if err != nil {
+		cs.Close()
+		return err
 	}
 
-	backendPool := startLocalPool(backend, opts.backendConns)
-	msc := mstp.NewConn(conn, conn, false, func(s *mstp.Stream) {
-		go func(s *mstp.Stream) {
-			defer s.Close()
-			bc, err := backendPool.get()
-			if err != nil {
-				slog.Error("get backend", "err", err)
-				return
-			}
+	interval := opts.interval
+	if !hello.Capabilities.Has(proto.CapKeepalive) {
+		interval = 0
+	}
+	var revoked atomic.Pointer[proto.Revoked]
+	err = cs.Run(interval, opts.timeout, func(msg proto.Message) {
+		switch msg := msg.(type) {
+		case *proto.Revoked:
+			revoked.Store(msg)
+			cs.Close()
+		}
+	})
+	if r := revoked.Load(); r != nil {
+		return r
+	}
+	return err
+}
 
-			slog.Debug("copy traffic", "stream", fmt.Sprintf("%p", s), "backend", bc.RemoteAddr().String())
+// runLink 建立一条 link 并等待其断开，ctx 结束时返回 nil。linked 表示是否已经握手成功
+func runLink(ctx context.Context, token string, backends *backendGroup, opts *linkOptions) (linked bool, err error) {
+	caps := []string{proto.CapRevokeNotice}
+	if opts.proxyProtocol != 0 {
+		caps = append(caps, proto.CapStreamMetadata)
+	}
+	if opts.compress {
+		caps = append(caps, proto.CapCompression)
+	}
+	conn, hello, err := dialExpose(token, opts.capabilities(caps...))
+	if err != nil {
+		return false, err
+	}
 
-			err = ioutil.DualCopy(s, bc)
-			if err != nil && err != io.EOF {
-				slog.Error("copy traffic", "stream", fmt.Sprintf("%p", s), "backend", bc.RemoteAddr().String(), "err", err)
-			}
-		}(s)
+	slog.Info("linked", "version", hello.Version, "expose", hello.BinaryVersion, "caps", hello.Capabilities)
+
+	if hello.Capabilities.Has(proto.CapCompression) {
+		fc := ioutil.NewFlateConn(conn)
+		defer func() {
+			st := fc.Stats()
+			slog.Info("link compression", "rawIn", st.RawIn, "wireIn", st.WireIn, "inRatio", st.InRatio(),
+				"rawOut", st.RawOut, "wireOut", st.WireOut, "outRatio", st.OutRatio())
+		}()
+		conn = fc
+	} else if opts.compress {
+		slog.Warn("expose does not allow compression, link is not compressed")
+	}
+
+	metadata := hello.Capabilities.Has(proto.CapStreamMetadata)
+	if opts.proxyProtocol != 0 && !metadata {
+		slog.Warn("expose does not send client addresses, proxy protocol headers will not carry them")
+	}
+	msc := mstp.NewConn(conn, conn, false, func(s *mstp.Stream) {
+		go serveBackendStream(s, backends, metadata, opts.proxyProtocol)
 	})
 	defer msc.Close()
 
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
-	sig := <-signals
-	slog.Info("stop", "signal", sig.String())
+	done := make(chan error, 1)
+	go func() {
+		done <- cmp.Or(msc.LastErr(), errLinkClosed)
+	}()
+	var control chan error
+	if hello.Capabilities.Has(proto.CapKeepalive) || hello.Capabilities.Has(proto.CapRevokeNotice) {
+		control = make(chan error, 1)
+		go func() {
+			err := serveControl(msc, hello, &opts.keepaliveOptions)
+			// 控制流不可用时 link 也就不可用了
+			msc.Close()
+			control <- err
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+		return true, nil
+	case err := <-done:
+		if control != nil {
+			// 优先使用控制流的错误，其中可能包含回收通知
+			select {
+			case cerr := <-control:
+				return true, cerr
+			case <-time.After(time.Second):
+			}
+		}
+		return true, err
+	case err := <-control:
+		return true, err
+	}
+}
+
+// linkLoop 保持 link 并在断开后重连，ctx 结束时返回 nil，无法继续重连时返回错误
+func linkLoop(ctx context.Context, token string, backends *backendGroup, opts *linkOptions) error {
+	const (
+		minRetryDelay = time.Second
+		maxRetryDelay = 30 * time.Second
+	)
+
+	everLinked := false
+	retryDelay := minRetryDelay
+	for {
+		start := time.Now()
+		linked, err := runLink(ctx, token, backends, opts)
+		if ctx.Err() != nil {
+			return nil
+		}
+		everLinked = everLinked || linked
+		var (
+			revoked *proto.Revoked
+			perr    *proto.Error
+		)
+		if errors.As(err, &revoked) || !everLinked || errors.As(err, &perr) {
+			// 被回收、首次连接失败或者 expose 拒绝连接时不再重试
+			return err
+		}
+
+		if time.Since(start) > maxRetryDelay {
+			retryDelay = minRetryDelay
+		}
+		slog.Warn("link disconnected", "err", err, "retry", retryDelay)
+		select {
+		case <-time.After(retryDelay):
+		case <-ctx.Done():
+			return nil
+		}
+		retryDelay = min(retryDelay*2, maxRetryDelay)
+	}
+}
+
+func linkMain(token string, backend string, command []string, opts *linkOptions) {
+	addresses, err := parseBackends(backend)
+	if err != nil {
+		fatal("backend:", err)
+	}
+	backends, err := newBackendGroup(addresses, opts.balance, &opts.localPoolOptions)
+	if err != nil {
+		fatal("backend:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var sup *processSupervisor
+	if len(command) != 0 {
+		sup, err = startProcessSupervisor(command, opts.maxRestarts)
+		if err != nil {
+			fatal("start process:", err)
+		}
+		go sup.forwardSignals()
+		go func() {
+			<-sup.done
+			cancel()
+		}()
+
+		// 其余的后端通常是备用实例，只等待第一个
+		err = sup.waitReady(ctx, addresses[0], opts.readyTimeout)
+		if err != nil {
+			sup.stop()
+			fatal("backend not ready:", err)
+		}
+	} else {
+		go func() {
+			waitSignal()
+			cancel()
+		}()
+	}
+
+	backends.start()
+
+	err = linkLoop(ctx, token, backends, opts)
+	if err != nil {
+		if sup != nil {
+			sup.stop()
+		}
+		var revoked *proto.Revoked
+		if errors.As(err, &revoked) {
+			fmt.Fprintln(os.Stderr, revoked.Error())
+			os.Exit(exitRevoked)
+		}
+		slog.Error("link", "err", err)
+		os.Exit(1)
+	}
+
+	if sup != nil {
+		// 进程退出后 link 已经没有意义
+		if opts.revokeOnExit {
+			_, err := postRevoke(token, fmt.Sprintf("backend process exited with code %d", sup.exitCode))
+			if err != nil {
+				slog.Warn("revoke token", "err", err)
+			}
+		}
+		os.Exit(sup.exitCode)
+	}
 }
 
 func linkCommand() *cobra.Command {
 	var opts linkOptions
+	var proxyProtocol string
 	cmd := &cobra.Command{
-		Use:   "link token backend",
+		Use:   "link token backend[,backend...] [-- command args...]",
 		Short: "Link expose with backend",
-		Args:  cobra.ExactArgs(2),
-		Run: func(_ *cobra.Command, args []string) {
-			linkMain(args[0], args[1], &opts)
+		Long: `Link expose with backend.
+
+If a command is given after --, it is started as the backend process. The link is established once the backend
+accepts connections, the process is restarted with backoff when it crashes, signals are forwarded to it, and the
+link is closed when it exits.
+
+Multiple backends are separated by commas, each has its own connection pool. Streams are balanced among them by
+--balance, a backend is skipped for a while after repeated dial failures, and the next one is tried when dialing fails.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if n := cmd.ArgsLenAtDash(); n >= 0 {
+				args = args[:n]
+			}
+			return cobra.ExactArgs(2)(cmd, args)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			var command []string
+			if n := cmd.ArgsLenAtDash(); n >= 0 {
+				command = args[n:]
+			}
+			var err error
+			opts.proxyProtocol, err = proxyproto.ParseVersion(proxyProtocol)
+			if err != nil {
+				fatal(err)
+			}
+			linkMain(args[0], args[1], command, &opts)
 		},
 	}
-	cmd.Flags().IntVar(&opts.backendConns, "backend-conns", 1, "backend conns")
+	opts.localPoolOptions.addFlags(cmd.Flags())
+	cmd.Flags().IntVar(&opts.maxRestarts, "max-restarts", 5, "max restarts of the command after crashes, negative for unlimited")
+	cmd.Flags().DurationVar(&opts.readyTimeout, "ready-timeout", time.Minute, "wait for the command to accept connections on backend")
+	cmd.Flags().StringVar(&proxyProtocol, "proxy-protocol", "", "write PROXY protocol header with the client address on backend connections: v1 or v2")
+	cmd.Flags().StringVar(&opts.balance, "balance", balanceRoundRobin, "how streams are balanced among backends: round-robin, least-conn or failover")
+	cmd.Flags().BoolVar(&opts.compress, "compress", false, "compress traffic on the link if expose allows it")
+	cmd.Flags().BoolVar(&opts.revokeOnExit, "revoke-on-exit", false, "revoke the token when the command exits")
+	opts.keepaliveOptions.addFlags(cmd.Flags())
 	return cmd
 }
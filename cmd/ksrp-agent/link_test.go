@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/vizee/ksrp/proto"
+)
+
+func TestShakeHandsWithLegacyExpose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// v1 的 expose 读取一个 v1 消息，不是 CmdShakeHands 时关闭连接
+			cmd, _, err := proto.ReadMessage(conn)
+			if err == nil && cmd == proto.CmdShakeHands {
+				proto.WriteMessage(conn, proto.CmdShakeHandsOk, "ok")
+			}
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = shakeHandsWithExpose(conn, "token", proto.NewCapabilities(proto.CapKeepalive))
+	if err == nil || !strings.Contains(err.Error(), "outdated") {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -1,66 +1,266 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
+	"math"
 	"math/rand/v2"
 	"net"
+	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// breakerThreshold 是熔断前连续失败的次数
+	breakerThreshold = 3
+	// breakerCooldown 是熔断后再次尝试连接后端的间隔
+	breakerCooldown = 5 * time.Second
+	// adaptInterval 是统计流到达速率并调整预连接数量的间隔
+	adaptInterval = time.Second
+	// dialWarnInterval 是预连接持续失败时输出警告的最小间隔
+	dialWarnInterval = 30 * time.Second
 )
 
+var errBackendDown = errors.New("backend is down")
+
+// sharedIdleMonitor 是所有后端连接池共用的空闲连接监视器
+var sharedIdleMonitor = sync.OnceValues(newIdleMonitor)
+
+type localPoolOptions struct {
+	preconnect int
+	// maxConns 是根据流到达速率扩大预连接时的上限，不大于 preconnect 时预连接数量固定
+	maxConns    int
+	dialTimeout time.Duration
+	// maxIdle 是预连接在池中的最长时间，超过后关闭并重新连接，0 表示不限制
+	maxIdle time.Duration
+	// probe 是连接进入池之前的就绪检查，为空时不检查
+	probe string
+}
+
+func (o *localPoolOptions) addFlags(fs *pflag.FlagSet) {
+	fs.IntVar(&o.preconnect, "backend-conns", 1, "backend conns, the minimum when --backend-max-conns is set")
+	fs.IntVar(&o.maxConns, "backend-max-conns", 0, "grow preconnected backend conns up to this with the stream arrival rate, 0 to keep --backend-conns")
+	fs.DurationVar(&o.dialTimeout, "backend-dial-timeout", 5*time.Second, "timeout of dialing backend")
+	fs.DurationVar(&o.maxIdle, "backend-max-idle", time.Minute, "close and reconnect preconnected backend conns idle longer than this, 0 to disable")
+	fs.StringVar(&o.probe, "backend-probe", "", "readiness probe before a preconnected conn is used: tcp://host:port, http://host:port/path or /path on backend")
+}
+
+// parseProbe 解析就绪检查的地址，省略主机时使用 backend
+func parseProbe(probe string, backend string) (*url.URL, error) {
+	if probe == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(probe, "/") {
+		probe = "http://" + backend + probe
+	}
+	u, err := url.Parse(probe)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		u.Host = backend
+	}
+	switch u.Scheme {
+	case "tcp", "http", "https":
+		return u, nil
+	default:
+		return nil, fmt.Errorf("unsupported probe %q", probe)
+	}
+}
+
+// circuitBreaker 在后端连续失败后熔断，冷却后只允许一次尝试，成功后恢复
+type circuitBreaker struct {
+	address   string
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+	trying    bool
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures < breakerThreshold {
+		return true
+	}
+	if b.trying || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.trying = true
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures >= breakerThreshold {
+		slog.Info("backend recovered", "backend", b.address)
+	}
+	b.failures = 0
+	b.trying = false
+}
+
+func (b *circuitBreaker) failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures++
+	b.trying = false
+	if b.failures >= breakerThreshold {
+		if b.failures == breakerThreshold {
+			slog.Warn("backend is down, failing streams fast", "backend", b.address, "cooldown", breakerCooldown)
+		}
+		b.openUntil = time.Now().Add(breakerCooldown)
+	}
+}
+
 type localConn struct {
 	conn net.Conn
+	pool *localPool
 	idx  int
 	free atomic.Bool
 }
 
 type localPool struct {
-	address    string
-	preconnect int
-	avail      []*localConn
-	lock       sync.Mutex
-	cond       sync.Cond
+	address  string
+	minConns int
+	maxConns int
+	// target 是当前预连接的数量，在 minConns 和 maxConns 之间调整
+	target      int
+	arrivals    atomic.Int64
+	monitor     *idleMonitor
+	dialTimeout time.Duration
+	maxIdle     time.Duration
+	probeURL    *url.URL
+	probeClient *http.Client
+	breaker     circuitBreaker
+	avail       []*localConn
+	lock        sync.Mutex
+	cond        sync.Cond
+	started     sync.Once
+}
+
+// closeConn 关闭已经从池中移除的连接
+func (p *localPool) closeConn(c *localConn) {
+	p.monitor.remove(c)
+	c.conn.Close()
 }
 
-func (p *localPool) checkConnAlive(c *localConn) {
-	err := checkTcpRead(c.conn.(*net.TCPConn))
+// dropConn 移除池中对端关闭或者提前有数据到达的连接
+func (p *localPool) dropConn(c *localConn, err error) {
+	p.lock.Lock()
+	ok := p.removeConnLocked(c)
+	p.lock.Unlock()
+	if !ok {
+		// 已经被取走或者淘汰
+		return
+	}
 	// TCP 读出现错误或者提前有数据到达都认为是异常情况
-	if err != nil || !c.free.Load() {
-		slog.Warn("checkTcpRead", "conn", c.conn.RemoteAddr().String(), "free", c.free.Load(), "err", err)
-		p.lock.Lock()
-		ok := p.removeConnLocked(c)
-		p.lock.Unlock()
-		if ok {
-			c.conn.Close()
+	slog.Warn("idle backend conn", "conn", c.conn.LocalAddr().String(), "err", err)
+	p.closeConn(c)
+}
+
+// evictConn 淘汰在池中超过 maxIdle 的连接
+func (p *localPool) evictConn(c *localConn) {
+	p.lock.Lock()
+	ok := p.removeConnLocked(c)
+	p.lock.Unlock()
+	if ok {
+		slog.Debug("evict idle backend conn", "conn", c.conn.LocalAddr().String())
+		p.closeConn(c)
+	}
+}
+
+// probe 检查后端是否就绪
+func (p *localPool) probe() error {
+	switch p.probeURL.Scheme {
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", p.probeURL.Host, p.dialTimeout)
+		if err != nil {
+			return err
 		}
-		return
+		return conn.Close()
+	default:
+		resp, err := p.probeClient.Get(p.probeURL.String())
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("probe %s: %s", p.probeURL.Redacted(), resp.Status)
+		}
+		return nil
 	}
 }
 
-func (p *localPool) addConn() {
-retry:
-	conn, err := net.Dial("tcp", p.address)
-	if err != nil {
-		slog.Warn("dial", "address", p.address, "err", err)
-		time.Sleep(time.Second)
-		goto retry
+// dial 连接后端并更新熔断状态，check 表示是否先进行就绪检查
+func (p *localPool) dial(check bool) (net.Conn, error) {
+	if check && p.probeURL != nil {
+		err := p.probe()
+		if err != nil {
+			p.breaker.failure()
+			return nil, err
+		}
 	}
-	c := &localConn{
-		conn: conn,
+	conn, err := net.DialTimeout("tcp", p.address, p.dialTimeout)
+	if err != nil {
+		p.breaker.failure()
+		return nil, err
 	}
-	p.lock.Lock()
-	c.idx = len(p.avail)
-	p.avail = append(p.avail, c)
-	p.lock.Unlock()
+	p.breaker.success()
+	return conn, nil
+}
+
+func (p *localPool) addConn() {
+	var lastWarn time.Time
+	for {
+		conn, err := p.dial(true)
+		if err == nil {
+			c := &localConn{
+				conn: conn,
+				pool: p,
+			}
+			p.lock.Lock()
+			// 在加入池时开始监视，避免连接被取走后才开始监视
+			err = p.monitor.add(c)
+			if err == nil {
+				c.idx = len(p.avail)
+				p.avail = append(p.avail, c)
+			}
+			p.lock.Unlock()
+			if err != nil {
+				slog.Error("monitor backend conn", "err", err)
+				conn.Close()
+				return
+			}
 
-	go p.checkConnAlive(c)
+			if p.maxIdle > 0 {
+				time.AfterFunc(p.maxIdle, func() {
+					p.evictConn(c)
+				})
+			}
+			return
+		}
+		if time.Since(lastWarn) >= dialWarnInterval {
+			slog.Warn("dial", "address", p.address, "err", err)
+			lastWarn = time.Now()
+		} else {
+			slog.Debug("dial", "address", p.address, "err", err)
+		}
+		time.Sleep(time.Second)
+	}
 }
 
 func (p *localPool) connect() {
 	for {
 		p.lock.Lock()
-		for len(p.avail) >= p.preconnect {
+		for len(p.avail) >= p.target {
 			p.cond.Wait()
 		}
 		p.lock.Unlock()
@@ -79,7 +279,7 @@ func (p *localPool) removeConnLocked(c *localConn) bool {
 	p.avail[c.idx] = p.avail[lastIdx]
 	p.avail = p.avail[:lastIdx]
 
-	if p.preconnect-lastIdx == 1 {
+	if len(p.avail) < p.target {
 		p.cond.Signal()
 	}
 	return true
@@ -87,36 +287,105 @@ func (p *localPool) removeConnLocked(c *localConn) bool {
 
 func (p *localPool) getAvail() (net.Conn, bool) {
 	p.lock.Lock()
-	defer p.lock.Unlock()
 	if len(p.avail) == 0 {
+		p.lock.Unlock()
 		return nil, false
 	}
 	c := p.avail[rand.IntN(len(p.avail))]
 	// cas 尽量获得有效的连接
 	ok := p.removeConnLocked(c)
+	p.lock.Unlock()
 	if !ok {
 		return nil, false
 	}
+	p.monitor.remove(c)
 	return c.conn, true
 }
 
+// resize 调整预连接的数量，关闭多出的空闲连接
+func (p *localPool) resize(target int) {
+	var extra []*localConn
+	p.lock.Lock()
+	if target != p.target {
+		slog.Debug("resize backend pool", "from", p.target, "to", target)
+	}
+	p.target = target
+	for len(p.avail) > target {
+		c := p.avail[len(p.avail)-1]
+		p.removeConnLocked(c)
+		extra = append(extra, c)
+	}
+	if len(p.avail) < target {
+		p.cond.Signal()
+	}
+	p.lock.Unlock()
+	for _, c := range extra {
+		p.closeConn(c)
+	}
+}
+
+// adapt 按照流到达速率的滑动平均调整预连接数量，使空闲连接大致能满足一个统计周期内到达的流
+func (p *localPool) adapt() {
+	const alpha = 0.3
+	var rate float64
+	for range time.Tick(adaptInterval) {
+		n := p.arrivals.Swap(0)
+		rate += alpha * (float64(n) - rate)
+		p.resize(min(max(int(math.Round(rate)), p.minConns), p.maxConns))
+	}
+}
+
+// get 返回一个后端连接，池中没有连接时直接连接后端，熔断时立即返回 errBackendDown
 func (p *localPool) get() (net.Conn, error) {
+	p.arrivals.Add(1)
 	conn, ok := p.getAvail()
 	if ok {
 		return conn, nil
 	}
-	return net.Dial("tcp", p.address)
+	if !p.breaker.allow() {
+		return nil, errBackendDown
+	}
+	return p.dial(false)
 }
 
-func startLocalPool(address string, preconnect int) *localPool {
+// newLocalPool 创建后端连接池，调用 start 后开始预连接
+func newLocalPool(address string, opts *localPoolOptions) (*localPool, error) {
+	probeURL, err := parseProbe(opts.probe, address)
+	if err != nil {
+		return nil, err
+	}
+	monitor, err := sharedIdleMonitor()
+	if err != nil {
+		return nil, err
+	}
 	p := &localPool{
-		address:    address,
-		preconnect: preconnect,
+		address:     address,
+		minConns:    opts.preconnect,
+		maxConns:    max(opts.maxConns, opts.preconnect),
+		target:      opts.preconnect,
+		monitor:     monitor,
+		dialTimeout: opts.dialTimeout,
+		maxIdle:     opts.maxIdle,
+		probeURL:    probeURL,
+		breaker:     circuitBreaker{address: address},
+		probeClient: &http.Client{
+			// 后端在本地，不使用代理
+			Transport: &http.Transport{DisableKeepAlives: true},
+			Timeout:   opts.dialTimeout,
+		},
 	}
 	p.cond.L = &p.lock
+	return p, nil
+}
 
-	if preconnect > 0 {
-		go p.connect()
-	}
-	return p
+// start 开始预连接，重复调用时不做任何事情
+func (p *localPool) start() {
+	p.started.Do(func() {
+		if p.maxConns > 0 {
+			go p.connect()
+		}
+		if p.maxConns > p.minConns {
+			go p.adapt()
+		}
+	})
 }
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/spf13/cobra"
 )
@@ -25,6 +27,14 @@ func fatal(args ...any) {
 	os.Exit(1)
 }
 
+// waitSignal 等待退出信号
+func waitSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	sig := <-signals
+	slog.Info("stop", "signal", sig.String())
+}
+
 func main() {
 	var (
 		logLevel string
@@ -37,6 +47,8 @@ func main() {
 				apiAddress = cmp.Or(apiAddress, config["api"])
 				apiKey = cmp.Or(apiKey, config["api_key"])
 				linkAddress = cmp.Or(linkAddress, config["link"])
+				proxyAddress = cmp.Or(proxyAddress, config["proxy"])
+				jumpAddress = cmp.Or(jumpAddress, config["jump"])
 			} else if !os.IsNotExist(err) {
 				slog.Warn("load config", "err", err)
 			}
@@ -52,9 +64,18 @@ func main() {
 		},
 	}
 	app.PersistentFlags().StringVar(&logLevel, "log-level", "info", "log level: debug/info/warn/error")
+	app.PersistentFlags().StringVar(&proxyAddress, "proxy", "", "proxy for API and link connections: http://, https:// or socks5:// with optional user:password@, defaults to HTTPS_PROXY/ALL_PROXY")
+	app.PersistentFlags().StringVar(&jumpAddress, "jump", "", "connect API and link through an SSH jump host: ssh://user@host:port")
+	app.PersistentFlags().StringVar(&jumpKey, "jump-key", "", "private key for the jump host, defaults to ssh-agent and ~/.ssh/id_*")
+	app.PersistentFlags().StringVar(&jumpKnownHosts, "jump-known-hosts", "", "known_hosts file to verify the jump host, defaults to ~/.ssh/known_hosts")
 	app.AddCommand(
 		listenCommand(),
 		linkCommand(),
+		forwardCommand(),
+		proxyCommand(),
+		dnsCommand(),
+		envCommand(),
+		mountsCommand(),
 		revokeCommand(),
 		portCommand(),
 		saveConfigCommand())
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+type mountFile struct {
+	Path string `json:"path"`
+	Mode int64  `json:"mode"`
+	Data []byte `json:"data"`
+}
+
+type serviceMounts struct {
+	Files   []mountFile `json:"files"`
+	Skipped []string    `json:"skipped"`
+}
+
+func getServiceMounts(service string, container string) (*serviceMounts, error) {
+	values := url.Values{
+		"service": []string{service},
+	}
+	if container != "" {
+		values.Set("container", container)
+	}
+	resp, err := apiClient.Get(getAPIUrl("/expose/mounts", values))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respData, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("API Error: %d %s", resp.StatusCode, string(bytes.TrimSpace(respData)))
+	}
+	var mounts serviceMounts
+	err = json.NewDecoder(resp.Body).Decode(&mounts)
+	if err != nil {
+		return nil, err
+	}
+	return &mounts, nil
+}
+
+// writeMountFile 把容器内路径的文件写到 dir 下对应的位置
+func writeMountFile(dir string, f *mountFile) (string, error) {
+	// 先按容器路径清理，避免 .. 逃出 dir
+	name := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+f.Path)))
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return "", err
+	}
+	mode := os.FileMode(f.Mode) & os.ModePerm
+	err = os.WriteFile(name, f.Data, mode)
+	if err != nil {
+		return "", err
+	}
+	// 文件已存在时 WriteFile 不会修改权限
+	return name, os.Chmod(name, mode)
+}
+
+func mountsCommand() *cobra.Command {
+	var (
+		dir       string
+		container string
+	)
+	cmd := &cobra.Command{
+		Use:   "mounts service",
+		Short: "Fetch ConfigMap and Secret volumes mounted by the workload selected by the service",
+		Long: `Fetch ConfigMap and Secret volumes mounted by the workload originally selected by the service, and write
+them under the directory at the container paths, e.g. /etc/app/config.yaml is written to ./mnt/etc/app/config.yaml.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(_ *cobra.Command, args []string) {
+			mounts, err := getServiceMounts(args[0], container)
+			if err != nil {
+				fatal("get service mounts:", err)
+			}
+			for _, s := range mounts.Skipped {
+				fmt.Fprintln(os.Stderr, "skipped:", s)
+			}
+			for i := range mounts.Files {
+				name, err := writeMountFile(dir, &mounts.Files[i])
+				if err != nil {
+					fatal("write mount file:", err)
+				}
+				fmt.Println(name)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&dir, "dir", "./mnt", "directory to write the files")
+	cmd.Flags().StringVar(&container, "container", "", "container name, defaults to the first container")
+	return cmd
+}
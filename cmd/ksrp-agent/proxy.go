@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vizee/ksrp/ioutil"
+	"github.com/vizee/ksrp/proto"
+	"github.com/vizee/mstp"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded          = 0x00
+	socks5ReplyNotAllowed         = 0x02
+	socks5ReplyHostUnreachable    = 0x04
+	socks5ReplyCommandUnsupported = 0x07
+	socks5ReplyAddrUnsupported    = 0x08
+)
+
+var (
+	errSocks5NoAcceptableMethod = errors.New("socks5: no acceptable auth method")
+	errSocks5UnsupportedCommand = errors.New("socks5: unsupported command")
+)
+
+type proxyOptions struct {
+	keepaliveOptions
+	listen string
+}
+
+func isNotAllowed(err error) bool {
+	var perr *proto.Error
+	return errors.As(err, &perr) && perr.Code == proto.ErrCodeNotAllowed
+}
+
+func relayProxyTraffic(conn net.Conn, st *mstp.Stream, address string) {
+	defer st.Close()
+
+	slog.Debug("copy proxy traffic", "conn", conn.RemoteAddr().String(), "address", address)
+
+	err := ioutil.DualCopy(conn, st)
+	if err != nil && err != io.EOF {
+		slog.Error("copy proxy traffic", "conn", conn.RemoteAddr().String(), "address", address, "err", err)
+	}
+}
+
+func readSocks5Address(br *bufio.Reader) (string, error) {
+	var header [4]byte
+	_, err := io.ReadFull(br, header[:])
+	if err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("socks5: bad version %d", header[0])
+	}
+	if header[1] != socks5CmdConnect {
+		return "", errSocks5UnsupportedCommand
+	}
+
+	var host string
+	switch header[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		size := net.IPv4len
+		if header[3] == socks5AddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		_, err = io.ReadFull(br, ip)
+		host = ip.String()
+	case socks5AddrDomain:
+		var n byte
+		n, err = br.ReadByte()
+		if err == nil {
+			domain := make([]byte, n)
+			_, err = io.ReadFull(br, domain)
+			host = string(domain)
+		}
+	default:
+		return "", fmt.Errorf("socks5: unsupported address type %d", header[3])
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var port [2]byte
+	_, err = io.ReadFull(br, port[:])
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+func writeSocks5Reply(conn net.Conn, reply byte) error {
+	// 不返回实际绑定的地址
+	_, err := conn.Write([]byte{socks5Version, reply, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func serveSocks5(session *exposeSession, conn net.Conn, br *bufio.Reader) error {
+	var header [2]byte
+	_, err := io.ReadFull(br, header[:])
+	if err != nil {
+		return err
+	}
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(br, methods)
+	if err != nil {
+		return err
+	}
+	// 只在本地监听，只支持无认证
+	noAuth := false
+	for _, m := range methods {
+		if m == 0x00 {
+			noAuth = true
+		}
+	}
+	if !noAuth {
+		_, _ = conn.Write([]byte{socks5Version, 0xff})
+		return errSocks5NoAcceptableMethod
+	}
+	_, err = conn.Write([]byte{socks5Version, 0x00})
+	if err != nil {
+		return err
+	}
+
+	address, err := readSocks5Address(br)
+	if err != nil {
+		reply := byte(socks5ReplyAddrUnsupported)
+		if err == errSocks5UnsupportedCommand {
+			reply = socks5ReplyCommandUnsupported
+		}
+		_ = writeSocks5Reply(conn, reply)
+		return err
+	}
+
+	st, err := session.dial(address)
+	if err != nil {
+		reply := byte(socks5ReplyHostUnreachable)
+		if isNotAllowed(err) {
+			reply = socks5ReplyNotAllowed
+		}
+		_ = writeSocks5Reply(conn, reply)
+		return err
+	}
+	err = writeSocks5Reply(conn, socks5ReplySucceeded)
+	if err != nil {
+		st.Close()
+		return err
+	}
+
+	relayProxyTraffic(ioutil.NewBufferedConn(conn, br), st, address)
+	return nil
+}
+
+func serveHTTPConnect(session *exposeSession, conn net.Conn, br *bufio.Reader) error {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return err
+	}
+	if req.Method != http.MethodConnect {
+		_, _ = io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		return fmt.Errorf("unsupported method %s", req.Method)
+	}
+
+	address := req.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "443")
+	}
+
+	st, err := session.dial(address)
+	if err != nil {
+		status := "502 Bad Gateway"
+		if isNotAllowed(err) {
+			status = "403 Forbidden"
+		}
+		_, _ = fmt.Fprintf(conn, "HTTP/1.1 %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", status)
+		return err
+	}
+	_, err = io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	if err != nil {
+		st.Close()
+		return err
+	}
+
+	relayProxyTraffic(ioutil.NewBufferedConn(conn, br), st, address)
+	return nil
+}
+
+func handleProxyConn(session *exposeSession, conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	first, err := br.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+
+	// 根据第一个字节区分 SOCKS5 和 HTTP CONNECT
+	if first[0] == socks5Version {
+		err = serveSocks5(session, conn, br)
+	} else {
+		err = serveHTTPConnect(session, conn, br)
+	}
+	if err != nil {
+		slog.Warn("proxy", "conn", conn.RemoteAddr().String(), "err", err)
+	}
+}
+
+func proxyMain(opts *proxyOptions) {
+	ln, err := net.Listen("tcp", opts.listen)
+	if err != nil {
+		fatal("listen:", err)
+	}
+	defer ln.Close()
+
+	session := newExposeSession(&opts.keepaliveOptions)
+	defer session.close()
+
+	slog.Info("proxy", "listen", ln.Addr().String())
+
+	go serveListener(ln, func(conn net.Conn) {
+		handleProxyConn(session, conn)
+	})
+
+	waitSignal()
+}
+
+func proxyCommand() *cobra.Command {
+	var opts proxyOptions
+	cmd := &cobra.Command{
+		Use:   "proxy",
+		Short: "Serve SOCKS5 and HTTP CONNECT proxy to cluster addresses through expose",
+		Args:  cobra.NoArgs,
+		Run: func(_ *cobra.Command, _ []string) {
+			proxyMain(&opts)
+		},
+	}
+	cmd.Flags().StringVar(&opts.listen, "listen", "127.0.0.1:1080", "proxy listen address")
+	opts.addFlags(cmd.Flags())
+	return cmd
+}
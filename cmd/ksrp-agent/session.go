@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/vizee/ksrp/proto"
+	"github.com/vizee/mstp"
+)
+
+var (
+	errDialUnsupported = errors.New("expose does not support dial")
+)
+
+// exposeSession 是不绑定 token 的 link，用于通过 expose 访问集群内的地址，断开后在下次使用时重连
+type exposeSession struct {
+	keepalive *keepaliveOptions
+	lock      sync.Mutex
+	msc       *mstp.Conn
+}
+
+func (s *exposeSession) connect() (*mstp.Conn, error) {
+	conn, hello, err := dialExpose("", s.keepalive.capabilities(proto.CapDial))
+	if err != nil {
+		return nil, err
+	}
+	if !hello.Capabilities.Has(proto.CapDial) {
+		conn.Close()
+		return nil, errDialUnsupported
+	}
+
+	slog.Debug("session connected", "version", hello.Version, "expose", hello.BinaryVersion, "caps", hello.Capabilities)
+
+	msc := mstp.NewConn(conn, conn, false, nil)
+	if hello.Capabilities.Has(proto.CapKeepalive) {
+		go func() {
+			err := serveControl(msc, hello, s.keepalive)
+			slog.Debug("session control stream", "err", err)
+			msc.Close()
+		}()
+	}
+	go func() {
+		err := msc.LastErr()
+		slog.Debug("session disconnected", "err", err)
+		s.lock.Lock()
+		if s.msc == msc {
+			s.msc = nil
+		}
+		s.lock.Unlock()
+	}()
+	return msc, nil
+}
+
+func (s *exposeSession) getConn() (*mstp.Conn, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.msc == nil {
+		msc, err := s.connect()
+		if err != nil {
+			return nil, err
+		}
+		s.msc = msc
+	}
+	return s.msc, nil
+}
+
+func (s *exposeSession) resetConn(msc *mstp.Conn) {
+	s.lock.Lock()
+	if s.msc == msc {
+		s.msc = nil
+	}
+	s.lock.Unlock()
+	msc.Close()
+}
+
+// dial 让 expose 连接 address，返回转发数据的流
+func (s *exposeSession) dial(address string) (*mstp.Stream, error) {
+	msc, err := s.getConn()
+	if err != nil {
+		return nil, err
+	}
+	st, err := msc.NewStream()
+	if err == mstp.ErrConnClosed {
+		s.resetConn(msc)
+		msc, err = s.getConn()
+		if err != nil {
+			return nil, err
+		}
+		st, err = msc.NewStream()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = proto.WriteFrame(st, &proto.OpenStream{
+		Kind:    proto.StreamDial,
+		Address: address,
+	})
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+	msg, err := proto.ReadFrame(st)
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+	switch msg := msg.(type) {
+	case *proto.OpenStreamOk:
+		return st, nil
+	case *proto.Error:
+		st.Close()
+		return nil, msg
+	default:
+		st.Close()
+		return nil, fmt.Errorf("unexpected message: %d", msg.Type())
+	}
+}
+
+func (s *exposeSession) close() {
+	s.lock.Lock()
+	msc := s.msc
+	s.msc = nil
+	s.lock.Unlock()
+	if msc != nil {
+		msc.Close()
+	}
+}
+
+func newExposeSession(keepalive *keepaliveOptions) *exposeSession {
+	return &exposeSession{
+		keepalive: keepalive,
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	minRestartDelay = time.Second
+	maxRestartDelay = 30 * time.Second
+	// stopTimeout 内进程没有退出则强制结束
+	stopTimeout = 10 * time.Second
+)
+
+// processSupervisor 运行本地后端进程，异常退出时按退避重启
+type processSupervisor struct {
+	command     []string
+	maxRestarts int
+
+	proc     *os.Process
+	lock     sync.Mutex
+	stopping atomic.Bool
+	exitCode int
+	done     chan struct{}
+}
+
+func (p *processSupervisor) start() error {
+	cmd := exec.Command(p.command[0], p.command[1:]...)
+	// 进程在独立的后台进程组中，读终端会被 SIGTTIN 停止，所以不传入终端，stdin 为 /dev/null
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	setProcessGroup(cmd)
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	slog.Info("start process", "command", p.command[0], "pid", cmd.Process.Pid)
+
+	p.lock.Lock()
+	p.proc = cmd.Process
+	p.lock.Unlock()
+	return nil
+}
+
+// wait 等待当前进程退出并返回退出码
+func (p *processSupervisor) wait() int {
+	p.lock.Lock()
+	proc := p.proc
+	p.lock.Unlock()
+
+	state, err := proc.Wait()
+	if err != nil {
+		slog.Error("wait process", "pid", proc.Pid, "err", err)
+		return 1
+	}
+	code := state.ExitCode()
+	if code < 0 {
+		// 和 shell 一样，被信号结束时使用 128+信号
+		code = 1
+		if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			code = 128 + int(ws.Signal())
+		}
+	}
+	slog.Info("process exited", "pid", proc.Pid, "state", state.String())
+	return code
+}
+
+func (p *processSupervisor) run() {
+	defer close(p.done)
+
+	restarts := 0
+	delay := minRestartDelay
+	for {
+		start := time.Now()
+		code := p.wait()
+		if code == 0 || p.stopping.Load() {
+			p.exitCode = code
+			return
+		}
+		if time.Since(start) > maxRestartDelay {
+			restarts = 0
+			delay = minRestartDelay
+		}
+		// 进程异常退出后，进程组中残留的子进程可能还占用着后端端口
+		p.signal(syscall.SIGKILL)
+		if p.maxRestarts >= 0 && restarts >= p.maxRestarts {
+			slog.Error("process restarted too many times", "restarts", restarts)
+			p.exitCode = code
+			return
+		}
+
+		slog.Warn("restart process", "code", code, "delay", delay)
+		time.Sleep(delay)
+		if p.stopping.Load() {
+			p.exitCode = code
+			return
+		}
+		err := p.start()
+		if err != nil {
+			slog.Error("start process", "err", err)
+			p.exitCode = 1
+			return
+		}
+		restarts++
+		delay = min(delay*2, maxRestartDelay)
+	}
+}
+
+func (p *processSupervisor) signal(sig os.Signal) {
+	p.lock.Lock()
+	proc := p.proc
+	p.lock.Unlock()
+	err := signalProcessGroup(proc, sig)
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
+		slog.Warn("signal process", "pid", proc.Pid, "signal", sig.String(), "err", err)
+	}
+}
+
+// forwardSignals 把退出信号转发给进程，进程退出后不再重启
+func (p *processSupervisor) forwardSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case sig := <-signals:
+			slog.Info("forward signal", "signal", sig.String())
+			p.stopping.Store(true)
+			p.signal(sig)
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// stop 结束进程并等待 supervisor 退出
+func (p *processSupervisor) stop() {
+	p.stopping.Store(true)
+	p.signal(syscall.SIGTERM)
+	select {
+	case <-p.done:
+	case <-time.After(stopTimeout):
+		p.signal(os.Kill)
+		<-p.done
+	}
+}
+
+// waitReady 等待 address 可以连接，进程退出或超时时返回错误
+func (p *processSupervisor) waitReady(ctx context.Context, address string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", address, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("wait for %s: %w", address, err)
+		}
+		select {
+		case <-p.done:
+			return fmt.Errorf("process exited with code %d before %s is ready", p.exitCode, address)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// startProcessSupervisor 启动进程，maxRestarts 小于 0 时不限制重启次数
+func startProcessSupervisor(command []string, maxRestarts int) (*processSupervisor, error) {
+	p := &processSupervisor{
+		command:     command,
+		maxRestarts: maxRestarts,
+		done:        make(chan struct{}),
+	}
+	err := p.start()
+	if err != nil {
+		return nil, err
+	}
+	go p.run()
+	return p, nil
+}
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"errors"
 	"io"
 	"net"
 	"syscall"
@@ -20,28 +21,28 @@ func sysrecv(fd uintptr, buf []byte, flags int) (uintptr, syscall.Errno) {
 	return n, err
 }
 
-// checkTcpRead 返回 nil 表示连接有数据，EOF 表示对端关闭
-func checkTcpRead(conn *net.TCPConn) error {
-	rawConn, err := conn.SyscallConn()
+// peekTcpRead 不阻塞地检查连接，返回 nil 表示连接有数据，EOF 表示对端关闭，EAGAIN 表示连接空闲
+func peekTcpRead(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return errors.New("not a tcp conn")
+	}
+	rawConn, err := tcpConn.SyscallConn()
 	if err != nil {
 		return err
 	}
 
 	var innerErr error
-	err = rawConn.Read(func(fd uintptr) bool {
+	err = rawConn.Control(func(fd uintptr) {
 		var buf [1]byte
+		// socket 已经是非阻塞的，没有数据时返回 EAGAIN
 		n, eno := sysrecv(fd, buf[:], syscall.MSG_PEEK)
 		if eno != 0 {
-			if eno == syscall.EAGAIN {
-				// 阻塞等待读就绪
-				return false
-			}
 			innerErr = eno
 		} else if n == 0 {
 			// 对端关闭连接
 			innerErr = io.EOF
 		}
-		return true
 	})
 	if err != nil {
 		return err
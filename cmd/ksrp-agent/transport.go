@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vizee/ksrp/ioutil"
+	"github.com/vizee/ksrp/proto"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	linkPath         = "/expose/link"
+	handshakeTimeout = 10 * time.Second
+)
+
+// proxyAddress 是 --proxy 指定的代理，为空时使用环境变量中的代理
+var proxyAddress string
+
+// normalizeProxy 补全代理地址的 scheme，socks5h 与 socks5 相同，都由代理解析域名
+func normalizeProxy(s string) string {
+	if s == "" {
+		return ""
+	}
+	if !strings.Contains(s, "://") {
+		return "http://" + s
+	}
+	if rest, ok := strings.CutPrefix(s, "socks5h://"); ok {
+		return "socks5://" + rest
+	}
+	return s
+}
+
+// envProxyFunc 使用 HTTPS_PROXY、HTTP_PROXY 和 NO_PROXY 选择代理，没有设置时使用 ALL_PROXY
+var envProxyFunc = sync.OnceValue(func() func(*url.URL) (*url.URL, error) {
+	conf := httpproxy.FromEnvironment()
+	all := normalizeProxy(cmp.Or(os.Getenv("ALL_PROXY"), os.Getenv("all_proxy")))
+	conf.HTTPProxy = cmp.Or(normalizeProxy(conf.HTTPProxy), all)
+	conf.HTTPSProxy = cmp.Or(normalizeProxy(conf.HTTPSProxy), all)
+	return conf.ProxyFunc()
+})
+
+// proxyURL 返回连接 target 时使用的代理，不使用代理时返回 nil
+func proxyURL(target *url.URL) (*url.URL, error) {
+	if proxyAddress != "" {
+		return url.Parse(normalizeProxy(proxyAddress))
+	}
+	// 环境变量中的代理只按照 http 和 https 选择，ws 对应 http，wss、ssh 等其余连接都按照 HTTPS 选择
+	u := *target
+	if u.Scheme == "ws" {
+		u.Scheme = "http"
+	} else if u.Scheme != "http" {
+		u.Scheme = "https"
+	}
+	u.Host = hostPort(target)
+	return envProxyFunc()(&u)
+}
+
+// apiClient 是访问 expose API 的 HTTP 客户端，使用与 link 相同的代理或者跳板机
+var apiClient = &http.Client{
+	Transport: func() http.RoundTripper {
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.Proxy = func(r *http.Request) (*url.URL, error) {
+			if jumpAddress != "" {
+				return nil, nil
+			}
+			return proxyURL(r.URL)
+		}
+		t.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			if jumpAddress != "" {
+				return jump.dial(address)
+			}
+			return dialer.DialContext(ctx, network, address)
+		}
+		return t
+	}(),
+}
+
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "https", "wss":
+		return net.JoinHostPort(u.Hostname(), "443")
+	case "socks5":
+		return net.JoinHostPort(u.Hostname(), "1080")
+	default:
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+}
+
+// handshakeHTTP 在 conn 上发送 req 并读取响应头，返回的 br 中可能缓冲了响应之后的数据
+func handshakeHTTP(conn net.Conn, req *http.Request) (*http.Response, *bufio.Reader, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	err := req.Write(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, br, nil
+}
+
+func responseError(prefix string, resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s: %s: %s", prefix, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// dialConnect 通过 HTTP 代理的 CONNECT 方法连接 address
+func dialConnect(p *url.URL, address string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", hostPort(p))
+	if err != nil {
+		return nil, err
+	}
+	if p.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: p.Hostname()})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if p.User != nil {
+		password, _ := p.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(p.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	resp, br, err := handshakeHTTP(conn, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := responseError("proxy connect", resp)
+		conn.Close()
+		return nil, err
+	}
+	return ioutil.NewBufferedConn(conn, br), nil
+}
+
+// dialDirect 连接 target 的主机，根据代理配置直接连接、使用 HTTP CONNECT 或者 SOCKS5 代理
+func dialDirect(target *url.URL) (net.Conn, error) {
+	address := hostPort(target)
+	p, err := proxyURL(target)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return net.Dial("tcp", address)
+	}
+
+	slog.Debug("dial through proxy", "proxy", p.Redacted(), "address", address)
+
+	switch p.Scheme {
+	case "http", "https":
+		return dialConnect(p, address)
+	case "socks5":
+		d, err := proxy.FromURL(p, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		return d.Dial("tcp", address)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", p.Scheme)
+	}
+}
+
+// dialTarget 连接 target 的主机，设置了跳板机时通过跳板机连接
+func dialTarget(target *url.URL) (net.Conn, error) {
+	if jumpAddress != "" {
+		return jump.dial(hostPort(target))
+	}
+	return dialDirect(target)
+}
+
+// dialWebSocket 通过 API 服务上的 WebSocket 建立 link
+func dialWebSocket(u *url.URL) (net.Conn, error) {
+	// ws:// 对应 http://，wss:// 对应 https://
+	origin := &url.URL{Scheme: "http" + strings.TrimPrefix(u.Scheme, "ws"), Host: u.Host}
+	config, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialTarget(u)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		conn = tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	ws, err := websocket.NewClient(config, conn)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// dialUpgrade 通过 API 端口上的 HTTP Upgrade 建立 link
+func dialUpgrade(u *url.URL) (net.Conn, error) {
+	conn, err := dialTarget(u)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+	}
+
+	if apiKey != "" {
+		values := u.Query()
+		values.Set("key", apiKey)
+		u.RawQuery = values.Encode()
+	}
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    u,
+		Host:   u.Host,
+		Header: http.Header{
+			"Connection": {"Upgrade"},
+			"Upgrade":    {proto.LinkUpgrade},
+		},
+	}
+	resp, br, err := handshakeHTTP(conn, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		err := responseError("upgrade link", resp)
+		conn.Close()
+		return nil, err
+	}
+	return ioutil.NewBufferedConn(conn, br), nil
+}
+
+// dialLink 连接 expose 的 link 地址。ws:// 和 wss:// 地址使用 WebSocket，http:// 和 https:// 地址使用 HTTP Upgrade，
+// 省略路径时使用 /expose/link；没有配置 link 地址时通过 API 地址建立 link
+func dialLink(address string) (net.Conn, error) {
+	if address == "" {
+		address = strings.TrimSuffix(apiAddress, "/") + linkPath
+	}
+	if !strings.Contains(address, "://") {
+		// link 端口上的连接按照 HTTPS 选择代理
+		return dialTarget(&url.URL{Scheme: "https", Host: address})
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = linkPath
+	}
+	switch u.Scheme {
+	case "ws", "wss":
+		return dialWebSocket(u)
+	case "http", "https":
+		return dialUpgrade(u)
+	default:
+		return nil, fmt.Errorf("unsupported link scheme %q", u.Scheme)
+	}
+}
@@ -2,21 +2,28 @@ package main
 
 import (
 	"cmp"
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/vizee/ksrp/expose"
 	"github.com/vizee/ksrp/kube"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
+	expose.Config `yaml:",inline"`
+
+	// Link 是 link 端口的监听地址，为空时 agent 只能通过 API 端口建立 link
 	Link          string     `yaml:"link"`
 	API           string     `yaml:"api"`
-	APIKey        string     `yaml:"apiKey"`
-	Namespace     string     `yaml:"namespace"`
-	AppName       string     `yaml:"appName"`
 	LogLevel      slog.Level `yaml:"logLevel"`
 	NoHijack      bool       `yaml:"noHijack"`
 	CreateService bool       `yaml:"createService"`
@@ -26,14 +33,6 @@ const (
 	operatorName = "ksrp-expose"
 )
 
-func loadExposeOperator(namespace string, allowCreate bool) (*kube.ExposeOperator, error) {
-	client, err := kube.InClusterClient(operatorName)
-	if err != nil {
-		return nil, err
-	}
-	return kube.NewExposeOperator(operatorName, client, namespace, allowCreate), nil
-}
-
 func fatal(args ...any) {
 	fmt.Fprintln(os.Stderr, args...)
 	os.Exit(1)
@@ -60,27 +59,69 @@ func main() {
 
 	slog.SetLogLoggerLevel(conf.LogLevel)
 
-	var operator *kube.ExposeOperator
+	var (
+		client   *kube.Client
+		operator *kube.ExposeOperator
+	)
 	if !conf.NoHijack {
 		var err error
-		operator, err = loadExposeOperator(conf.Namespace, conf.CreateService)
+		client, err = kube.InClusterClient(operatorName)
 		if err != nil {
 			fatal(err)
 		}
+		operator = kube.NewExposeOperator(operatorName, client, conf.Namespace, conf.CreateService)
 	}
 
-	server := newServer(conf.AppName, operator)
-
-	slog.Info("listen link", "address", conf.Link)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
-	ln, err := net.Listen("tcp", conf.Link)
+	server, err := expose.NewServer(&conf.Config, client, operator)
 	if err != nil {
-		fatal("listen link", err)
+		fatal("new server", err)
 	}
-	go server.serveAgent(ln)
 
-	err = serveAPI(server, conf.API, conf.APIKey)
-	if err != nil {
+	// 先回收所有 token 通知 agent 后再关闭 link
+	linkCtx, cancelLink := context.WithCancel(context.Background())
+	defer cancelLink()
+	// 没有配置 link 时只能通过 API 端口建立 link
+	if conf.Link != "" {
+		slog.Info("listen link", "address", conf.Link)
+
+		ln, err := net.Listen("tcp", conf.Link)
+		if err != nil {
+			fatal("listen link", err)
+		}
+		go func() {
+			err := server.ServeLink(linkCtx, ln)
+			if err != nil && linkCtx.Err() == nil {
+				slog.Error("serve link", "err", err)
+			}
+		}()
+	}
+
+	slog.Info("listen API", "address", conf.API)
+
+	apiServer := &http.Server{
+		Addr:    conf.API,
+		Handler: server.Handler(),
+	}
+	context.AfterFunc(ctx, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		apiServer.Shutdown(ctx)
+	})
+
+	err = apiServer.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		slog.Error("serve api", "err", err)
 	}
+
+	slog.Info("shutdown")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		slog.Warn("shutdown", "err", err)
+	}
 }
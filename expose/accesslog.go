@@ -0,0 +1,131 @@
+package expose
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// accessLogEntry 是一个服务连接的访问日志
+type accessLogEntry struct {
+	Kind     string    `json:"kind"`
+	Service  string    `json:"service"`
+	Token    string    `json:"token"`
+	Client   string    `json:"client"`
+	Agent    string    `json:"agent,omitempty"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"durationMs"`
+	BytesIn  int64     `json:"bytesIn"`
+	BytesOut int64     `json:"bytesOut"`
+	Reason   string    `json:"closeReason"`
+}
+
+// countingConn 统计服务连接上读写的字节数
+type countingConn struct {
+	io.ReadWriter
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriter.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriter.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// accessLogger 以 JSON lines 写访问日志，写文件时按大小轮转
+type accessLogger struct {
+	name       string
+	maxSize    int64
+	maxBackups int
+
+	out  io.Writer
+	file *os.File
+	size int64
+	lock sync.Mutex
+}
+
+func (l *accessLogger) open() error {
+	f, err := os.OpenFile(l.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.out = f
+	l.size = fi.Size()
+	return nil
+}
+
+// rotate 把当前文件重命名为 name.1，已有的备份依次后移，超过 maxBackups 的被覆盖
+func (l *accessLogger) rotate() error {
+	l.file.Close()
+	var err error
+	if l.maxBackups > 0 {
+		for i := l.maxBackups - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", l.name, i), fmt.Sprintf("%s.%d", l.name, i+1))
+		}
+		err = os.Rename(l.name, l.name+".1")
+	} else {
+		err = os.Remove(l.name)
+	}
+	// 即使重命名失败也重新打开文件，继续写日志
+	return errors.Join(err, l.open())
+}
+
+// log 写入一行日志，entry 是 *accessLogEntry 或 *httpLogEntry
+func (l *accessLogger) log(entry any) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file != nil && l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		err = l.rotate()
+		if err != nil {
+			slog.Error("rotate access log", "name", l.name, "err", err)
+		}
+	}
+	n, err := l.out.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		slog.Error("write access log", "name", l.name, "err", err)
+	}
+}
+
+// newAccessLogger 打开访问日志，name 为 "-" 时写到标准输出
+func newAccessLogger(name string, maxSize int64, maxBackups int) (*accessLogger, error) {
+	l := &accessLogger{
+		name:       name,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if name == "-" {
+		l.out = os.Stdout
+		return l, nil
+	}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,143 @@
+package expose
+
+import (
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/vizee/ksrp/proto"
+	"github.com/vizee/mstp"
+)
+
+// agentConn 是一个已经完成握手的 agent 连接
+type agentConn struct {
+	*mstp.Conn
+	svc     *Service
+	remote  string
+	caps    proto.Capabilities
+	control chan *proto.ControlStream
+	cs      atomic.Pointer[proto.ControlStream]
+	done    chan struct{}
+}
+
+// hasControl 返回 agent 是否会打开控制流
+func (ac *agentConn) hasControl() bool {
+	return ac.caps.Has(proto.CapKeepalive) || ac.caps.Has(proto.CapRevokeNotice)
+}
+
+// revoke 通知 agent token 被回收，等待 agent 断开或超时后关闭连接
+func (ac *agentConn) revoke(notice *proto.Revoked) {
+	const revokeGracePeriod = time.Second
+
+	cs := ac.cs.Load()
+	if notice != nil && cs != nil && ac.caps.Has(proto.CapRevokeNotice) {
+		err := cs.Send(notice)
+		if err == nil {
+			// 直接关闭连接会丢弃 agent 尚未读取的消息
+			select {
+			case <-ac.done:
+			case <-time.After(revokeGracePeriod):
+			}
+		}
+	}
+	ac.Close()
+}
+
+// handleAgentStream 处理 agent 主动打开的流
+func (s *Server) handleAgentStream(ac *agentConn, st *mstp.Stream) {
+	msg, err := proto.ReadFrame(st)
+	if err != nil {
+		slog.Debug("read agent stream", "conn", ac.remote, "err", err)
+		st.Close()
+		return
+	}
+	open, ok := msg.(*proto.OpenStream)
+	if !ok {
+		slog.Debug("unexpected agent stream", "conn", ac.remote, "type", msg.Type())
+		st.Close()
+		return
+	}
+	switch open.Kind {
+	case proto.StreamControl:
+		select {
+		case ac.control <- proto.NewControlStream(st):
+		default:
+			slog.Debug("duplicate control stream", "conn", ac.remote)
+			st.Close()
+		}
+	case proto.StreamDial:
+		s.handleDialStream(ac, st, open.Address)
+	default:
+		slog.Debug("unknown agent stream", "conn", ac.remote, "kind", open.Kind)
+		st.Close()
+	}
+}
+
+// newAgentConn 创建 agent 连接，svc 为 nil 表示不绑定 token 的会话
+func (s *Server) newAgentConn(svc *Service, conn net.Conn, caps proto.Capabilities) *agentConn {
+	ac := &agentConn{
+		svc:     svc,
+		remote:  conn.RemoteAddr().String(),
+		caps:    caps,
+		control: make(chan *proto.ControlStream, 1),
+		done:    make(chan struct{}),
+	}
+	ac.Conn = mstp.NewConn(conn, conn, true, func(st *mstp.Stream) {
+		go s.handleAgentStream(ac, st)
+	})
+	return ac
+}
+
+func (s *Server) capabilities() proto.Capabilities {
+	caps := []string{proto.CapRevokeNotice, proto.CapDial, proto.CapStreamMetadata}
+	if s.conf.KeepaliveInterval > 0 {
+		caps = append(caps, proto.CapKeepalive)
+	}
+	if s.conf.AllowCompression {
+		caps = append(caps, proto.CapCompression)
+	}
+	return proto.NewCapabilities(caps...)
+}
+
+// removeFromService 从服务中移除 agent 连接，使其不再被分配新的流
+func (ac *agentConn) removeFromService() {
+	if ac.svc != nil {
+		ac.svc.removeAgentConn(ac)
+	}
+}
+
+// serveControl 等待 agent 打开控制流并保持 keepalive，控制流异常时移除并关闭 agent 连接
+func (s *Server) serveControl(ac *agentConn) {
+	var cs *proto.ControlStream
+	select {
+	case cs = <-ac.control:
+	case <-time.After(s.conf.KeepaliveTimeout):
+		slog.Warn("wait agent control stream timeout", "conn", ac.remote)
+		ac.removeFromService()
+		ac.Close()
+		return
+	case <-ac.done:
+		return
+	}
+
+	ac.cs.Store(cs)
+
+	interval := s.conf.KeepaliveInterval
+	if !ac.caps.Has(proto.CapKeepalive) {
+		interval = 0
+	}
+	err := cs.Run(interval, s.conf.KeepaliveTimeout, nil)
+	select {
+	case <-ac.done:
+		return
+	default:
+	}
+	if ac.svc != nil && ac.svc.closed.Load() {
+		return
+	}
+	// 控制流异常意味着 agent 连接已经不可用
+	slog.Warn("agent control stream closed", "conn", ac.remote, "err", err)
+	ac.removeFromService()
+	ac.Close()
+}
@@ -0,0 +1,306 @@
+package expose
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vizee/ksrp/ioutil"
+	"github.com/vizee/ksrp/kube"
+	"github.com/vizee/ksrp/proto"
+	"github.com/vizee/ksrp/proxyproto"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+type apiServer struct {
+	inner         *Server
+	apiKey        string
+	linkWebSocket http.Handler
+}
+
+func (s *apiServer) checkAuth(w http.ResponseWriter, r *http.Request) bool {
+	if s.apiKey != "" && r.FormValue("key") != s.apiKey {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (s *apiServer) postListen(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAuth(w, r) {
+		return
+	}
+
+	service := r.FormValue("service")
+	port, _ := strconv.Atoi(r.FormValue("port"))
+	if port <= 0 {
+		http.Error(w, "invalid port", http.StatusBadRequest)
+		return
+	}
+
+	var opts listenOptions
+	switch proxyProtocol := r.FormValue("proxyProtocol"); proxyProtocol {
+	case "":
+	case "any":
+		opts.acceptProxy = true
+	default:
+		version, err := proxyproto.ParseVersion(proxyProtocol)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.acceptProxy = true
+		opts.proxyVersion = version
+	}
+	opts.passClient, _ = strconv.ParseBool(r.FormValue("passClient"))
+	opts.httpLog, _ = strconv.ParseBool(r.FormValue("httpLog"))
+	maxConns, _ := strconv.Atoi(r.FormValue("maxConns"))
+	bandwidthIn, _ := strconv.ParseInt(r.FormValue("bandwidthIn"), 10, 64)
+	bandwidthOut, _ := strconv.ParseInt(r.FormValue("bandwidthOut"), 10, 64)
+	var err1, err2, err3 error
+	opts.maxConns, err1 = limitWithin(maxConns, s.inner.conf.MaxServiceConns)
+	opts.bandwidthIn, err2 = limitWithin(bandwidthIn, s.inner.conf.MaxServiceBandwidthIn)
+	opts.bandwidthOut, err3 = limitWithin(bandwidthOut, s.inner.conf.MaxServiceBandwidthOut)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	slog.Info("listen service", "name", service, "port", port, "acceptProxy", opts.acceptProxy, "passClient", opts.passClient, "httpLog", opts.httpLog, "maxConns", opts.maxConns, "bandwidthIn", opts.bandwidthIn, "bandwidthOut", opts.bandwidthOut)
+
+	svc, err := s.inner.listenService(service, port, &opts)
+	if err != nil {
+		slog.Error("listen service", "port", port, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("hijack service", "name", service, "token", svc.token)
+
+	err = s.inner.hijackService(r.Context(), service, port)
+	if err != nil {
+		slog.Error("hijack service", "service", service, "port", port, "err", err)
+
+		// 尝试释放监听
+		err2 := s.inner.revokeToken(context.Background(), svc.token, false, nil)
+		if err2 != nil {
+			slog.Warn("revoke token", "err", err2)
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte(svc.token))
+}
+
+func (s *apiServer) postRevoke(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAuth(w, r) {
+		return
+	}
+
+	err := s.inner.revokeToken(r.Context(), r.FormValue("token"), true, &proto.Revoked{
+		Reason: r.FormValue("reason"),
+		By:     cmp.Or(r.FormValue("by"), r.RemoteAddr),
+	})
+	if err != nil {
+		slog.Warn("revoke token", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func (s *apiServer) getPort(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAuth(w, r) {
+		return
+	}
+
+	port, _ := strconv.Atoi(r.FormValue("port"))
+	svc := s.inner.getPort(port)
+	if svc == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	fmt.Fprintf(w, "%s\n%s\n", svc.token, svc.name)
+}
+
+func (s *apiServer) getServices(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAuth(w, r) {
+		return
+	}
+
+	if s.inner.kc == nil {
+		http.Error(w, "kubernetes client not available", http.StatusNotImplemented)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	services, err := s.inner.kc.ListServices(ctx, s.inner.conf.Namespace)
+	if err != nil {
+		slog.Error("list services", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(services)
+}
+
+func workloadErrorStatus(err error) int {
+	if errors.Is(err, kube.ErrNoWorkload) || errors.Is(err, kube.ErrNoContainer) || apierrors.IsNotFound(err) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *apiServer) getEnv(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAuth(w, r) {
+		return
+	}
+
+	if !s.inner.conf.EnvImport {
+		http.Error(w, "env import disabled", http.StatusForbidden)
+		return
+	}
+	if s.inner.operator == nil {
+		http.Error(w, "kubernetes client not available", http.StatusNotImplemented)
+		return
+	}
+
+	service := r.FormValue("service")
+	if service == "" {
+		http.Error(w, "invalid service", http.StatusBadRequest)
+		return
+	}
+
+	// 只允许读取通过 listen 劫持的服务，避免泄露命名空间中其他工作负载的配置
+	if !s.inner.hasService(service) {
+		http.Error(w, "service is not exposed", http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	env, skipped, err := s.inner.operator.ServiceEnv(ctx, service, r.FormValue("container"), s.inner.conf.EnvSecrets)
+	if err != nil {
+		slog.Error("resolve service env", "service", service, "err", err)
+		http.Error(w, err.Error(), workloadErrorStatus(err))
+		return
+	}
+
+	slog.Info("export service env", "service", service, "vars", len(env), "skipped", len(skipped), "remote", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"env":     env,
+		"skipped": skipped,
+	})
+}
+
+func (s *apiServer) getMounts(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAuth(w, r) {
+		return
+	}
+
+	if !s.inner.conf.MountImport {
+		http.Error(w, "mount import disabled", http.StatusForbidden)
+		return
+	}
+	if s.inner.operator == nil {
+		http.Error(w, "kubernetes client not available", http.StatusNotImplemented)
+		return
+	}
+
+	service := r.FormValue("service")
+	if service == "" {
+		http.Error(w, "invalid service", http.StatusBadRequest)
+		return
+	}
+
+	if !s.inner.hasService(service) {
+		http.Error(w, "service is not exposed", http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	files, skipped, err := s.inner.operator.ServiceMounts(ctx, service, r.FormValue("container"), s.inner.conf.MountSecrets)
+	if err != nil {
+		slog.Error("resolve service mounts", "service", service, "err", err)
+		http.Error(w, err.Error(), workloadErrorStatus(err))
+		return
+	}
+
+	slog.Info("export service mounts", "service", service, "files", len(files), "skipped", len(skipped), "remote", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"files":   files,
+		"skipped": skipped,
+	})
+}
+
+// getLink 在 API 端口上建立 agent 连接，使用 Upgrade: ksrp-link 时需要 API key，否则作为 WebSocket 连接处理
+func (s *apiServer) getLink(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), proto.LinkUpgrade) {
+		s.linkWebSocket.ServeHTTP(w, r)
+		return
+	}
+	if !s.checkAuth(w, r) {
+		return
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	_, err = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + proto.LinkUpgrade + "\r\n\r\n")
+	if err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		slog.Debug("upgrade agent connection", "conn", r.RemoteAddr, "err", err)
+		return
+	}
+
+	slog.Debug("new agent upgraded connection", "conn", r.RemoteAddr)
+
+	ctx, cancel := s.inner.apiLinkContext(r.Context())
+	defer cancel()
+	s.inner.handleAgentConn(ctx, ioutil.NewBufferedConn(conn, brw.Reader))
+}
+
+func (s *apiServer) getHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// Handler 返回 expose API 的 http.Handler
+func (s *Server) Handler() http.Handler {
+	api := &apiServer{
+		inner:         s,
+		apiKey:        s.conf.APIKey,
+		linkWebSocket: s.linkWebSocket(),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /expose/listen", api.postListen)
+	mux.HandleFunc("POST /expose/revoke", api.postRevoke)
+	mux.HandleFunc("GET /expose/port", api.getPort)
+	mux.HandleFunc("GET /expose/services", api.getServices)
+	mux.HandleFunc("GET /expose/env", api.getEnv)
+	mux.HandleFunc("GET /expose/mounts", api.getMounts)
+	mux.HandleFunc("GET /expose/link", api.getLink)
+	mux.HandleFunc("GET /-/healthz", api.getHealthz)
+	mux.HandleFunc("GET /-/metrics", api.getMetrics)
+	return mux
+}
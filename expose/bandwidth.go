@@ -0,0 +1,111 @@
+package expose
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	minBandwidthBurst = 1024
+	maxBandwidthBurst = 64 * 1024
+)
+
+// newBandwidthLimiter 创建每秒 bps 字节的令牌桶，bps 不大于 0 时返回 nil
+func newBandwidthLimiter(bps int64) *rate.Limiter {
+	if bps <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bps), int(min(max(bps, minBandwidthBurst), maxBandwidthBurst)))
+}
+
+// bandwidthLimiters 是一个方向上依次生效的限速器
+type bandwidthLimiters []*rate.Limiter
+
+func newBandwidthLimiters(limiters ...*rate.Limiter) bandwidthLimiters {
+	var ls bandwidthLimiters
+	for _, l := range limiters {
+		if l != nil {
+			ls = append(ls, l)
+		}
+	}
+	return ls
+}
+
+// chunk 返回每次读写的最大字节数，不能超过任何一个令牌桶的容量
+func (ls bandwidthLimiters) chunk() int {
+	n := maxBandwidthBurst
+	for _, l := range ls {
+		n = min(n, l.Burst())
+	}
+	return n
+}
+
+func (ls bandwidthLimiters) wait(ctx context.Context, n int) error {
+	for _, l := range ls {
+		err := l.WaitN(ctx, n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shapedConn 限制服务连接上读（客户端到 agent）和写（agent 到客户端）的速率，ctx 结束后等待中的读写返回错误
+type shapedConn struct {
+	io.ReadWriter
+	ctx context.Context
+	in  bandwidthLimiters
+	out bandwidthLimiters
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	if len(c.in) == 0 {
+		return c.ReadWriter.Read(p)
+	}
+	n, err := c.ReadWriter.Read(p[:min(len(p), c.in.chunk())])
+	if n > 0 {
+		werr := c.in.wait(c.ctx, n)
+		if werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	if len(c.out) == 0 {
+		return c.ReadWriter.Write(p)
+	}
+	chunk := c.out.chunk()
+	written := 0
+	for written < len(p) {
+		n := min(len(p)-written, chunk)
+		err := c.out.wait(c.ctx, n)
+		if err != nil {
+			return written, err
+		}
+		n, err = c.ReadWriter.Write(p[written : written+n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// shapeServiceConn 在需要限速时包装服务连接，ctx 应该在服务连接结束时取消
+func (s *Server) shapeServiceConn(ctx context.Context, svc *Service, rw io.ReadWriter) io.ReadWriter {
+	in := newBandwidthLimiters(svc.bandwidthIn, s.bandwidthIn)
+	out := newBandwidthLimiters(svc.bandwidthOut, s.bandwidthOut)
+	if len(in) == 0 && len(out) == 0 {
+		return rw
+	}
+	return &shapedConn{
+		ReadWriter: rw,
+		ctx:        ctx,
+		in:         in,
+		out:        out,
+	}
+}
@@ -0,0 +1,33 @@
+package expose
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShapedConnCancel(t *testing.T) {
+	s := &Server{}
+	svc := &Service{bandwidthOut: newBandwidthLimiter(minBandwidthBurst)}
+	ctx, cancel := context.WithCancel(context.Background())
+	cc := s.shapeServiceConn(ctx, svc, &bufferReadWriter{r: strings.NewReader("")})
+
+	// 1KiB/s 的限速下需要等待几十秒
+	done := make(chan error, 1)
+	go func() {
+		_, err := cc.Write(make([]byte, 32*1024))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("write returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shaped write is not cancelled")
+	}
+}
@@ -0,0 +1,72 @@
+package expose
+
+import (
+	"cmp"
+	"time"
+)
+
+const (
+	defaultKeepaliveInterval = 15 * time.Second
+	defaultKeepaliveTimeout  = 45 * time.Second
+	defaultAccessLogMaxSize  = 100 << 20
+	defaultConnQueueTimeout  = 5 * time.Second
+	defaultConnQueueSize     = 128
+)
+
+type Config struct {
+	// AppName 是 ksrp-expose 自身的 app 标签，劫持的 Service 会指向该 app
+	AppName string `yaml:"appName"`
+	APIKey  string `yaml:"apiKey"`
+	// Namespace 是 ksrp-expose 管理的 Service 所在的命名空间
+	Namespace string `yaml:"namespace"`
+	// ServiceHost 是服务端口的监听地址，为空时监听所有地址
+	ServiceHost string `yaml:"serviceHost"`
+	// KeepaliveInterval 是向 agent 发送 Ping 的间隔，小于 0 时不启用 keepalive
+	KeepaliveInterval time.Duration `yaml:"keepaliveInterval"`
+	// KeepaliveTimeout 内没有收到 agent 的消息则断开连接
+	KeepaliveTimeout time.Duration `yaml:"keepaliveTimeout"`
+	// DialAllow 是允许 agent 通过 expose 访问的地址，为空时禁止访问，例如：
+	// "*.default.svc.cluster.local:80"、"10.0.0.0/8"、"redis:*"
+	DialAllow []string `yaml:"dialAllow"`
+	// MaxConns 是所有服务连接和 agent 请求的 dial 的并发上限，0 表示不限制
+	MaxConns int `yaml:"maxConns"`
+	// MaxServiceConns 是每个服务的并发连接上限，listen 时可以指定更小的值，0 表示不限制
+	MaxServiceConns int `yaml:"maxServiceConns"`
+	// ConnLimitMode 是达到并发上限时的行为：reject 直接拒绝，queue 等待 ConnQueueTimeout 后拒绝
+	ConnLimitMode string `yaml:"connLimitMode"`
+	// ConnQueueTimeout 是 queue 模式下等待空位的时间
+	ConnQueueTimeout time.Duration `yaml:"connQueueTimeout"`
+	// ConnQueueSize 是 queue 模式下同时等待空位的连接数上限，队列已满时直接拒绝
+	ConnQueueSize int `yaml:"connQueueSize"`
+	// BandwidthIn 和 BandwidthOut 是所有服务共享的每秒字节数上限，In 是客户端到 agent 的方向，0 表示不限制
+	BandwidthIn  int64 `yaml:"bandwidthIn"`
+	BandwidthOut int64 `yaml:"bandwidthOut"`
+	// MaxServiceBandwidthIn 和 MaxServiceBandwidthOut 是每个服务的每秒字节数上限，listen 时可以指定更小的值
+	MaxServiceBandwidthIn  int64 `yaml:"maxServiceBandwidthIn"`
+	MaxServiceBandwidthOut int64 `yaml:"maxServiceBandwidthOut"`
+	// AllowCompression 允许 agent 在 link 上启用压缩
+	AllowCompression bool `yaml:"allowCompression"`
+	// AccessLog 是服务连接访问日志的路径，"-" 表示标准输出，为空时不记录
+	AccessLog string `yaml:"accessLog"`
+	// AccessLogMaxSize 是访问日志文件轮转的字节数，小于 0 时不轮转
+	AccessLogMaxSize int64 `yaml:"accessLogMaxSize"`
+	// AccessLogMaxBackups 是保留的已轮转的访问日志数量，为 0 时轮转会删除旧日志
+	AccessLogMaxBackups int `yaml:"accessLogMaxBackups"`
+	// EnvImport 允许 agent 读取被劫持 Service 对应工作负载的环境变量
+	EnvImport bool `yaml:"envImport"`
+	// EnvSecrets 允许导入来自 Secret 的环境变量，需要同时授予读取 Secret 的权限
+	EnvSecrets bool `yaml:"envSecrets"`
+	// MountImport 允许 agent 读取被劫持 Service 对应工作负载挂载的 ConfigMap 和 Secret 文件
+	MountImport bool `yaml:"mountImport"`
+	// MountSecrets 允许导入挂载的 Secret 文件，需要同时授予读取 Secret 的权限
+	MountSecrets bool `yaml:"mountSecrets"`
+}
+
+func (c *Config) setDefaults() {
+	c.KeepaliveInterval = cmp.Or(c.KeepaliveInterval, defaultKeepaliveInterval)
+	c.KeepaliveTimeout = cmp.Or(c.KeepaliveTimeout, defaultKeepaliveTimeout)
+	c.AccessLogMaxSize = cmp.Or(c.AccessLogMaxSize, defaultAccessLogMaxSize)
+	c.ConnLimitMode = cmp.Or(c.ConnLimitMode, LimitReject)
+	c.ConnQueueTimeout = cmp.Or(c.ConnQueueTimeout, defaultConnQueueTimeout)
+	c.ConnQueueSize = cmp.Or(c.ConnQueueSize, defaultConnQueueSize)
+}
@@ -0,0 +1,135 @@
+package expose
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/vizee/ksrp/ioutil"
+	"github.com/vizee/ksrp/proto"
+	"github.com/vizee/mstp"
+)
+
+const (
+	dialTimeout = 5 * time.Second
+)
+
+// dialRule 是一条允许 agent 访问的目标规则，格式为 host[:port]。
+// host 可以是 CIDR 或者 path.Match 风格的通配符，port 为空或 * 时匹配所有端口
+type dialRule struct {
+	host   string
+	prefix netip.Prefix
+	port   string
+}
+
+func (r *dialRule) match(host string, port string) bool {
+	if r.port != "" && r.port != "*" && r.port != port {
+		return false
+	}
+	if r.prefix.IsValid() {
+		addr, err := netip.ParseAddr(host)
+		return err == nil && r.prefix.Contains(addr.Unmap())
+	}
+	ok, _ := path.Match(r.host, strings.ToLower(host))
+	return ok
+}
+
+func parseDialRule(pattern string) (*dialRule, error) {
+	host, port, err := net.SplitHostPort(pattern)
+	if err != nil {
+		host, port = pattern, ""
+	}
+	rule := &dialRule{
+		host: strings.ToLower(host),
+		port: port,
+	}
+	if strings.Contains(host, "/") {
+		rule.prefix, err = netip.ParsePrefix(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dial rule %q: %w", pattern, err)
+		}
+	} else if _, err := path.Match(rule.host, ""); err != nil {
+		return nil, fmt.Errorf("invalid dial rule %q: %w", pattern, err)
+	}
+	return rule, nil
+}
+
+func parseDialRules(patterns []string) ([]*dialRule, error) {
+	rules := make([]*dialRule, 0, len(patterns))
+	for _, pattern := range patterns {
+		rule, err := parseDialRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (s *Server) allowDial(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	for _, rule := range s.dialRules {
+		if rule.match(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleDialStream 连接 agent 请求的地址，在流上转发数据
+func (s *Server) handleDialStream(ac *agentConn, st *mstp.Stream, address string) {
+	defer st.Close()
+
+	if !s.allowDial(address) {
+		slog.Warn("dial not allowed", "conn", ac.remote, "address", address)
+		_ = proto.WriteFrame(st, &proto.Error{
+			Code:    proto.ErrCodeNotAllowed,
+			Message: fmt.Sprintf("dial %s not allowed", address),
+		})
+		return
+	}
+
+	ok := s.limiter.acquire(0)
+	if !ok && s.enterQueue() {
+		ok = s.limiter.acquire(s.conf.ConnQueueTimeout)
+		s.leaveQueue()
+	}
+	if !ok {
+		s.rejected.Add(1)
+		slog.Warn("dial rejected", "conn", ac.remote, "address", address, "limit", "global")
+		_ = proto.WriteFrame(st, &proto.Error{
+			Code:    proto.ErrCodeBusy,
+			Message: "too many connections",
+		})
+		return
+	}
+	defer s.limiter.release()
+
+	slog.Debug("dial", "conn", ac.remote, "address", address)
+
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		slog.Warn("dial", "conn", ac.remote, "address", address, "err", err)
+		_ = proto.WriteFrame(st, &proto.Error{Message: err.Error()})
+		return
+	}
+	defer conn.Close()
+
+	err = proto.WriteFrame(st, &proto.OpenStreamOk{})
+	if err != nil {
+		return
+	}
+
+	err = ioutil.DualCopy(st, conn)
+	if err != nil && err != io.EOF {
+		slog.Debug("copy dial traffic", "conn", ac.remote, "address", address, "err", err)
+	}
+}
@@ -0,0 +1,241 @@
+package expose
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// httpTapChunks 和 httpTapBytes 限制每个方向等待解析的数据块数量和字节数，解析跟不上转发时放弃解析
+	httpTapChunks = 16
+	httpTapBytes  = 64 * 1024
+)
+
+// httpTap 把转发的数据复制给解析协程，写入不会阻塞转发
+type httpTap struct {
+	lock    sync.Mutex
+	ch      chan []byte
+	closed  bool
+	stopped atomic.Bool
+	// queued 是已经写入还没有被读取的字节数
+	queued atomic.Int64
+	buf    []byte
+}
+
+func newHTTPTap() *httpTap {
+	return &httpTap{
+		ch: make(chan []byte, httpTapChunks),
+	}
+}
+
+func (t *httpTap) write(p []byte) {
+	if t.stopped.Load() {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return
+	}
+	if t.queued.Add(int64(len(p))) <= httpTapBytes {
+		select {
+		case t.ch <- bytes.Clone(p):
+			return
+		default:
+		}
+	}
+	// 缓冲已满，丢弃数据并结束解析
+	t.queued.Add(-int64(len(p)))
+	t.stopped.Store(true)
+	t.closeLocked()
+}
+
+func (t *httpTap) closeLocked() {
+	if !t.closed {
+		t.closed = true
+		close(t.ch)
+	}
+}
+
+func (t *httpTap) close() {
+	t.lock.Lock()
+	t.closeLocked()
+	t.lock.Unlock()
+}
+
+// stop 在解析结束后调用，之后的数据不再复制
+func (t *httpTap) stop() {
+	t.stopped.Store(true)
+}
+
+func (t *httpTap) Read(p []byte) (int, error) {
+	if len(t.buf) == 0 {
+		b, ok := <-t.ch
+		if !ok {
+			return 0, io.EOF
+		}
+		t.queued.Add(-int64(len(b)))
+		t.buf = b
+	}
+	n := copy(p, t.buf)
+	t.buf = t.buf[n:]
+	return n, nil
+}
+
+// httpLogEntry 是一个 HTTP 请求的访问日志，Latency 是收到响应头的耗时
+type httpLogEntry struct {
+	Kind      string    `json:"kind"`
+	Service   string    `json:"service"`
+	Client    string    `json:"client"`
+	Start     time.Time `json:"start"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Latency   float64   `json:"latencyMs"`
+	ReqBytes  int64     `json:"reqBytes"`
+	RespBytes int64     `json:"respBytes"`
+
+	reqBytes atomic.Int64
+}
+
+// httpObserver 被动解析服务连接上的 HTTP/1.x 请求和响应，解析失败或者协议升级后不再解析
+type httpObserver struct {
+	service string
+	client  string
+	log     func(*httpLogEntry)
+
+	req, resp *httpTap
+	pending   chan *httpLogEntry
+	stop      chan struct{}
+}
+
+func isUpgrade(h http.Header) bool {
+	return strings.EqualFold(h.Get("Connection"), "upgrade") || h.Get("Upgrade") != ""
+}
+
+func (o *httpObserver) readRequests() {
+	defer close(o.pending)
+	defer o.req.stop()
+
+	br := bufio.NewReader(o.req)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		entry := &httpLogEntry{
+			Kind:    "http",
+			Service: o.service,
+			Client:  o.client,
+			Start:   time.Now(),
+			Method:  req.Method,
+			Host:    req.Host,
+			Path:    req.URL.RequestURI(),
+		}
+		select {
+		case o.pending <- entry:
+		case <-o.stop:
+			return
+		}
+		if req.Method == http.MethodConnect || isUpgrade(req.Header) {
+			return
+		}
+		n, err := io.Copy(io.Discard, req.Body)
+		entry.reqBytes.Store(n)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (o *httpObserver) readResponses() {
+	defer close(o.stop)
+	defer o.resp.stop()
+
+	br := bufio.NewReader(o.resp)
+	for entry := range o.pending {
+		req := &http.Request{Method: entry.Method}
+		resp, err := http.ReadResponse(br, req)
+		// 跳过 100 Continue 等中间响应
+		for err == nil && resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			resp, err = http.ReadResponse(br, req)
+		}
+		if err != nil {
+			return
+		}
+		entry.Status = resp.StatusCode
+		entry.Latency = float64(time.Since(entry.Start).Microseconds()) / 1000
+		if resp.StatusCode == http.StatusSwitchingProtocols || entry.Method == http.MethodConnect {
+			entry.ReqBytes = entry.reqBytes.Load()
+			o.log(entry)
+			return
+		}
+		n, err := io.Copy(io.Discard, resp.Body)
+		entry.RespBytes = n
+		entry.ReqBytes = entry.reqBytes.Load()
+		o.log(entry)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (o *httpObserver) close() {
+	o.req.close()
+	o.resp.close()
+}
+
+func newHTTPObserver(service string, client string, log func(*httpLogEntry)) *httpObserver {
+	o := &httpObserver{
+		service: service,
+		client:  client,
+		log:     log,
+		pending: make(chan *httpLogEntry, 64),
+		stop:    make(chan struct{}),
+		req:     newHTTPTap(),
+		resp:    newHTTPTap(),
+	}
+	go o.readRequests()
+	go o.readResponses()
+	return o
+}
+
+// observedConn 把服务连接上的数据复制给 httpObserver，不修改转发的数据
+type observedConn struct {
+	io.ReadWriter
+	o *httpObserver
+}
+
+func (c *observedConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriter.Read(p)
+	if n > 0 {
+		c.o.req.write(p[:n])
+	}
+	return n, err
+}
+
+func (c *observedConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriter.Write(p)
+	if n > 0 {
+		c.o.resp.write(p[:n])
+	}
+	return n, err
+}
+
+// logHTTP 把 HTTP 请求写到访问日志，没有开启访问日志时写到服务日志
+func (s *Server) logHTTP(entry *httpLogEntry) {
+	if s.accessLog != nil {
+		s.accessLog.log(entry)
+		return
+	}
+	slog.Info("http request", "service", entry.Service, "client", entry.Client, "method", entry.Method, "host", entry.Host, "path", entry.Path,
+		"status", entry.Status, "latencyMs", entry.Latency, "reqBytes", entry.ReqBytes, "respBytes", entry.RespBytes)
+}
@@ -0,0 +1,100 @@
+package expose
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+type bufferReadWriter struct {
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (b *bufferReadWriter) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+func (b *bufferReadWriter) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
+
+func TestObservedConn(t *testing.T) {
+	entries := make(chan *httpLogEntry, 1)
+	o := newHTTPObserver("web", "client", func(e *httpLogEntry) {
+		entries <- e
+	})
+	defer o.close()
+	rw := &bufferReadWriter{r: strings.NewReader("GET /index HTTP/1.1\r\nHost: web\r\n\r\n")}
+	c := &observedConn{ReadWriter: rw, o: o}
+
+	_, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-entries:
+		if e.Method != "GET" || e.Path != "/index" || e.Status != 200 || e.RespBytes != 2 {
+			t.Fatalf("unexpected entry: %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request is not logged")
+	}
+}
+
+func TestObservedConnServerFirst(t *testing.T) {
+	o := newHTTPObserver("banner", "client", func(*httpLogEntry) {})
+	defer o.close()
+	rw := &bufferReadWriter{r: strings.NewReader("")}
+	c := &observedConn{ReadWriter: rw, o: o}
+
+	// 没有请求时后端先发送数据，转发不能等待解析
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		chunk := bytes.Repeat([]byte("x"), 16*1024)
+		for range 4 * httpTapChunks {
+			c.Write(chunk)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocks on the http observer")
+	}
+	if rw.w.Len() != 4*httpTapChunks*16*1024 {
+		t.Fatalf("forwarded %d bytes", rw.w.Len())
+	}
+}
+
+func TestHTTPTapSlowParser(t *testing.T) {
+	tap := newHTTPTap()
+	// 解析协程没有读取时，超过上限的数据被丢弃
+	chunk := bytes.Repeat([]byte("x"), 10*1024)
+	for range 10 * httpTapBytes / len(chunk) {
+		tap.write(chunk)
+	}
+	if !tap.stopped.Load() {
+		t.Fatal("tap is not stopped")
+	}
+	if n := tap.queued.Load(); n > httpTapBytes {
+		t.Fatalf("queued %d bytes", n)
+	}
+	n, err := io.Copy(io.Discard, tap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n > httpTapBytes {
+		t.Fatalf("read %d bytes from tap", n)
+	}
+	if tap.queued.Load() != 0 {
+		t.Fatalf("queued %d bytes after read", tap.queued.Load())
+	}
+}
@@ -0,0 +1,123 @@
+package expose
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// LimitReject 在达到并发上限时直接拒绝连接
+	LimitReject = "reject"
+	// LimitQueue 在达到并发上限时等待空位，超时后拒绝
+	LimitQueue = "queue"
+)
+
+// connLimiter 限制并发连接数，nil 表示不限制
+type connLimiter struct {
+	sem chan struct{}
+}
+
+func newConnLimiter(n int) *connLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &connLimiter{sem: make(chan struct{}, n)}
+}
+
+// acquire 获取一个空位，timeout 为 0 时不等待
+func (l *connLimiter) acquire(timeout time.Duration) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+	}
+	if timeout <= 0 {
+		return false
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (l *connLimiter) release() {
+	if l != nil {
+		<-l.sem
+	}
+}
+
+func (l *connLimiter) capacity() int {
+	if l == nil {
+		return 0
+	}
+	return cap(l.sem)
+}
+
+func (l *connLimiter) inUse() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.sem)
+}
+
+// enterQueue 在 queue 模式下占用一个等待位置，reject 模式或者队列已满时返回 false
+func (s *Server) enterQueue() bool {
+	if s.queue == nil {
+		return false
+	}
+	select {
+	case s.queue <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) leaveQueue() {
+	<-s.queue
+}
+
+// limitWithin 返回 listen 时为服务指定的上限，requested 为 0 时使用服务端的上限，不能超过服务端的上限
+func limitWithin[T int | int64](requested T, limit T) (T, error) {
+	if requested < 0 {
+		return 0, fmt.Errorf("invalid limit %d", requested)
+	}
+	if requested > 0 && (limit <= 0 || requested < limit) {
+		limit = requested
+	}
+	return limit, nil
+}
+
+// acquireServiceConn 为服务连接获取全局和服务的并发空位，等待其中一个时不占用另一个，失败时返回被拒绝的范围
+func (s *Server) acquireServiceConn(svc *Service, timeout time.Duration) (release func(), scope string) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if !s.limiter.acquire(time.Until(deadline)) {
+			return nil, "global"
+		}
+		if svc.limiter.acquire(0) {
+			break
+		}
+		s.limiter.release()
+		if !svc.limiter.acquire(time.Until(deadline)) {
+			return nil, "service"
+		}
+		if s.limiter.acquire(0) {
+			break
+		}
+		svc.limiter.release()
+	}
+	svc.active.Add(1)
+	return func() {
+		svc.active.Add(-1)
+		s.limiter.release()
+		svc.limiter.release()
+	}, ""
+}
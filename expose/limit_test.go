@@ -0,0 +1,53 @@
+package expose
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcquireServiceConn(t *testing.T) {
+	s, err := NewServer(&Config{MaxConns: 1, ConnLimitMode: LimitQueue, ConnQueueSize: 1}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Service{limiter: newConnLimiter(1)}
+	b := &Service{limiter: newConnLimiter(1)}
+
+	release, _ := s.acquireServiceConn(a, 0)
+	if release == nil {
+		t.Fatal("first connection is rejected")
+	}
+	_, scope := s.acquireServiceConn(b, 0)
+	if scope != "global" {
+		t.Fatalf("rejected by %q, want global", scope)
+	}
+
+	// 等待全局空位时不占用服务的空位
+	admitted := make(chan func(), 1)
+	go func() {
+		release, _ := s.acquireServiceConn(b, 5*time.Second)
+		admitted <- release
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if n := b.limiter.inUse(); n != 0 {
+		t.Fatalf("service slots in use while waiting: %d", n)
+	}
+	release()
+	select {
+	case release := <-admitted:
+		if release == nil {
+			t.Fatal("queued connection is rejected")
+		}
+		release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued connection is not admitted")
+	}
+
+	if !s.enterQueue() {
+		t.Fatal("queue is full")
+	}
+	if s.enterQueue() {
+		t.Fatal("queue is not bounded")
+	}
+	s.leaveQueue()
+}
@@ -0,0 +1,55 @@
+package expose
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// writeMetrics 以 Prometheus 文本格式输出并发连接相关的指标
+func (s *Server) writeMetrics(w io.Writer) {
+	s.lock.RLock()
+	services := make([]*Service, 0, len(s.tokens))
+	for _, svc := range s.tokens {
+		services = append(services, svc)
+	}
+	s.lock.RUnlock()
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].port < services[j].port
+	})
+
+	fmt.Fprintln(w, "# HELP ksrp_connections_active Concurrent service connections and dial streams.")
+	fmt.Fprintln(w, "# TYPE ksrp_connections_active gauge")
+	fmt.Fprintf(w, "ksrp_connections_active %d\n", s.limiter.inUse())
+	fmt.Fprintln(w, "# HELP ksrp_connections_limit Limit of concurrent service connections and dial streams, 0 for unlimited.")
+	fmt.Fprintln(w, "# TYPE ksrp_connections_limit gauge")
+	fmt.Fprintf(w, "ksrp_connections_limit %d\n", s.limiter.capacity())
+	fmt.Fprintln(w, "# HELP ksrp_connections_rejected_total Connections and dial streams rejected by the global limit.")
+	fmt.Fprintln(w, "# TYPE ksrp_connections_rejected_total counter")
+	fmt.Fprintf(w, "ksrp_connections_rejected_total %d\n", s.rejected.Load())
+	fmt.Fprintln(w, "# HELP ksrp_connections_queued Service connections and dial streams waiting for a free slot.")
+	fmt.Fprintln(w, "# TYPE ksrp_connections_queued gauge")
+	fmt.Fprintf(w, "ksrp_connections_queued %d\n", len(s.queue))
+
+	fmt.Fprintln(w, "# HELP ksrp_service_connections_active Concurrent connections of the service.")
+	fmt.Fprintln(w, "# TYPE ksrp_service_connections_active gauge")
+	for _, svc := range services {
+		fmt.Fprintf(w, "ksrp_service_connections_active{service=%q,port=\"%d\"} %d\n", svc.name, svc.port, svc.active.Load())
+	}
+	fmt.Fprintln(w, "# HELP ksrp_service_connections_limit Limit of concurrent connections of the service, 0 for unlimited.")
+	fmt.Fprintln(w, "# TYPE ksrp_service_connections_limit gauge")
+	for _, svc := range services {
+		fmt.Fprintf(w, "ksrp_service_connections_limit{service=%q,port=\"%d\"} %d\n", svc.name, svc.port, svc.limiter.capacity())
+	}
+	fmt.Fprintln(w, "# HELP ksrp_service_connections_rejected_total Connections of the service rejected by the service or global limit.")
+	fmt.Fprintln(w, "# TYPE ksrp_service_connections_rejected_total counter")
+	for _, svc := range services {
+		fmt.Fprintf(w, "ksrp_service_connections_rejected_total{service=%q,port=\"%d\"} %d\n", svc.name, svc.port, svc.rejected.Load())
+	}
+}
+
+func (s *apiServer) getMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.inner.writeMetrics(w)
+}
@@ -0,0 +1,646 @@
+package expose
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vizee/ksrp/ioutil"
+	"github.com/vizee/ksrp/kube"
+	"github.com/vizee/ksrp/proto"
+	"github.com/vizee/ksrp/proxyproto"
+	"golang.org/x/time/rate"
+)
+
+var (
+	errBadShakeHands = errors.New("unexpected sha")
+	errInvalidToken  = errors.New("invalid token")
+	errUnauthorized  = errors.New("unauthorized")
+)
+
+// listenOptions 是 listen 时为服务端口指定的选项
+type listenOptions struct {
+	// acceptProxy 表示连接以 PROXY 协议头开始，proxyVersion 为 0 时接受 v1 和 v2
+	acceptProxy  bool
+	proxyVersion int
+	// passClient 把协议头中的客户端地址而不是负载均衡的地址发送给 agent
+	passClient bool
+	// httpLog 被动解析 HTTP/1.x 请求并记录每个请求
+	httpLog bool
+	// maxConns 是服务的并发连接上限，0 表示不限制
+	maxConns int
+	// bandwidthIn 和 bandwidthOut 是服务每个方向的每秒字节数上限，0 表示不限制
+	bandwidthIn  int64
+	bandwidthOut int64
+}
+
+type Service struct {
+	ln    net.Listener
+	token string
+	name  string
+	port  int
+	opts  listenOptions
+
+	limiter      *connLimiter
+	active       atomic.Int64
+	rejected     atomic.Int64
+	bandwidthIn  *rate.Limiter
+	bandwidthOut *rate.Limiter
+
+	closed atomic.Bool
+	signal chan struct{}
+	acs    []*agentConn
+	lock   sync.Mutex
+}
+
+func (s *Service) close(notice *proto.Revoked) {
+	if !s.closed.CompareAndSwap(false, true) {
+		return
+	}
+	s.ln.Close()
+
+	s.lock.Lock()
+	acs := s.acs
+	s.acs = nil
+	s.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, ac := range acs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ac.revoke(notice)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Service) removeAgentConn(ac *agentConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, c := range s.acs {
+		if c == ac {
+			lastIdx := len(s.acs) - 1
+			last := s.acs[lastIdx]
+			s.acs[lastIdx] = nil
+			s.acs[i] = last
+			s.acs = s.acs[:lastIdx]
+			break
+		}
+	}
+}
+
+func (s *Service) addAgentConn(ac *agentConn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed.Load() {
+		return false
+	}
+
+	s.acs = append(s.acs, ac)
+
+	return true
+}
+
+func (s *Service) getAgentConn() (*agentConn, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.acs) == 0 {
+		return nil, false
+	}
+
+	return s.acs[mathrand.IntN(len(s.acs))], true
+}
+
+func generateToken() string {
+	var rnd [18]byte
+	_, _ = rand.Read(rnd[:])
+	return base64.RawURLEncoding.EncodeToString(rnd[:])
+}
+
+type Server struct {
+	conf      Config
+	kc        *kube.Client
+	operator  *kube.ExposeOperator
+	dialRules []*dialRule
+	accessLog *accessLogger
+	limiter   *connLimiter
+	rejected  atomic.Int64
+	// queue 限制 queue 模式下等待空位的连接数，reject 模式下为 nil
+	queue chan struct{}
+	// bandwidthIn 和 bandwidthOut 是所有服务共享的限速器
+	bandwidthIn  *rate.Limiter
+	bandwidthOut *rate.Limiter
+	ports        map[int]*Service
+	tokens       map[string]*Service
+	lock         sync.RWMutex
+	// apiLinks 在 Shutdown 时取消，结束 API 端口上建立的 agent 连接
+	apiLinks       context.Context
+	cancelAPILinks context.CancelFunc
+}
+
+// rejectServiceConn 关闭没有获得并发空位的服务连接
+func (s *Server) rejectServiceConn(svc *Service, sc net.Conn, scope string, reason string) {
+	svc.rejected.Add(1)
+	if scope == "global" {
+		s.rejected.Add(1)
+	}
+	// 拒绝的连接不读取 PROXY 协议头，记录的是直接连接的地址
+	slog.Warn("service connection rejected", "service", svc.name, "client", sc.RemoteAddr().String(), "limit", scope, "reason", reason)
+	if s.accessLog != nil {
+		s.accessLog.log(&accessLogEntry{
+			Kind:    "conn",
+			Service: svc.name,
+			Token:   svc.token,
+			Client:  sc.RemoteAddr().String(),
+			Start:   time.Now(),
+			Reason:  reason,
+		})
+	}
+	sc.Close()
+}
+
+// handleServiceConn 转发已经获得并发空位的服务连接，结束时调用 release
+func (s *Server) handleServiceConn(svc *Service, sc net.Conn, release func()) {
+	defer release()
+
+	var (
+		entry   *accessLogEntry
+		counter *countingConn
+	)
+	if s.accessLog != nil {
+		entry = &accessLogEntry{
+			Kind:    "conn",
+			Service: svc.name,
+			Token:   svc.token,
+			Client:  sc.RemoteAddr().String(),
+			Start:   time.Now(),
+		}
+		defer func() {
+			entry.Duration = float64(time.Since(entry.Start).Microseconds()) / 1000
+			if counter != nil {
+				entry.BytesIn = counter.read.Load()
+				entry.BytesOut = counter.written.Load()
+			}
+			s.accessLog.log(entry)
+		}()
+	}
+	// closeReason 记录连接结束的原因，没有开启访问日志时忽略
+	closeReason := func(reason string) {
+		if entry != nil {
+			entry.Reason = reason
+		}
+	}
+	defer sc.Close()
+
+	clientAddr := sc.RemoteAddr()
+	metadata := &proto.StreamMetadata{
+		ClientAddr: sc.RemoteAddr().String(),
+		DestAddr:   sc.LocalAddr().String(),
+	}
+	if svc.opts.acceptProxy {
+		pc, err := proxyproto.Accept(sc, svc.opts.proxyVersion, 5*time.Second)
+		if err != nil {
+			slog.Warn("read proxy protocol header", "service", svc.name, "conn", sc.RemoteAddr().String(), "err", err)
+			closeReason("proxy protocol: " + err.Error())
+			return
+		}
+		clientAddr = pc.ClientAddr()
+		if svc.opts.passClient && pc.Header.Source.IsValid() {
+			metadata.ClientAddr = pc.Header.Source.String()
+			metadata.DestAddr = pc.Header.Destination.String()
+		}
+		sc = pc
+	}
+	if entry != nil {
+		entry.Client = clientAddr.String()
+	}
+
+	slog.Debug("new service connection", "service", svc.name, "port", svc.port, "client", clientAddr.String())
+
+	ac, ok := svc.getAgentConn()
+	if !ok {
+		slog.Debug("no agent connection available", "service", svc.name)
+		closeReason("no agent")
+		return
+	}
+	if entry != nil {
+		entry.Agent = ac.remote
+	}
+	as, err := ac.NewStream()
+	if err != nil {
+		slog.Error("new agent stream", "ac", fmt.Sprintf("%p", ac), "err", err)
+		closeReason("new agent stream: " + err.Error())
+		return
+	}
+	defer as.Close()
+
+	if ac.caps.Has(proto.CapStreamMetadata) {
+		err = proto.WriteFrame(as, metadata)
+		if err != nil {
+			slog.Error("write stream metadata", "ac", fmt.Sprintf("%p", ac), "err", err)
+			closeReason("write stream metadata: " + err.Error())
+			return
+		}
+	}
+
+	// DualCopy 返回时取消，让另一个方向上等待令牌的读写尽快结束
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cc := s.shapeServiceConn(ctx, svc, sc)
+	if entry != nil {
+		// 只在需要时包装，避免 DualCopy 无法使用 TCPConn 的 ReadFrom
+		counter = &countingConn{ReadWriter: cc}
+		cc = counter
+	}
+	if svc.opts.httpLog {
+		o := newHTTPObserver(svc.name, clientAddr.String(), s.logHTTP)
+		defer o.close()
+		cc = &observedConn{ReadWriter: cc, o: o}
+	}
+
+	slog.Debug("copy traffic", "sc", sc.RemoteAddr().String(), "ac", fmt.Sprintf("%p", ac))
+	err = ioutil.DualCopy(cc, as)
+	if err != nil && err != io.EOF {
+		slog.Error("copy traffic", "sc", sc.RemoteAddr().String(), "ac", fmt.Sprintf("%p", ac), "err", err)
+		closeReason(err.Error())
+	} else {
+		closeReason("closed")
+	}
+}
+
+func (s *Server) serveService(svc *Service) {
+	for {
+		sc, err := svc.ln.Accept()
+		if err != nil {
+			if svc.closed.Load() {
+				return
+			}
+			slog.Warn("accept service connection", "port", svc.port, "err", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		// 在接受连接的协程中获取空位，被拒绝的连接不会创建协程
+		release, scope := s.acquireServiceConn(svc, 0)
+		if release != nil {
+			go s.handleServiceConn(svc, sc, release)
+			continue
+		}
+		if !s.enterQueue() {
+			reason := "limit: " + scope
+			if s.queue != nil {
+				reason = "queue full"
+			}
+			s.rejectServiceConn(svc, sc, scope, reason)
+			continue
+		}
+		go func() {
+			release, scope := s.acquireServiceConn(svc, s.conf.ConnQueueTimeout)
+			s.leaveQueue()
+			if release == nil {
+				s.rejectServiceConn(svc, sc, scope, "limit: "+scope)
+				return
+			}
+			s.handleServiceConn(svc, sc, release)
+		}()
+	}
+}
+
+func (s *Server) listenService(service string, port int, opts *listenOptions) (*Service, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(s.conf.ServiceHost, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	token := generateToken()
+	svc := &Service{
+		ln:           ln,
+		token:        token,
+		name:         service,
+		port:         port,
+		opts:         *opts,
+		limiter:      newConnLimiter(opts.maxConns),
+		bandwidthIn:  newBandwidthLimiter(opts.bandwidthIn),
+		bandwidthOut: newBandwidthLimiter(opts.bandwidthOut),
+		signal:       make(chan struct{}, 1),
+	}
+
+	// 如果能 listen 成功，那么 port 必然不会冲突，以及忽略 token 冲突的情况
+	s.lock.Lock()
+	s.ports[port] = svc
+	s.tokens[token] = svc
+	s.lock.Unlock()
+
+	go s.serveService(svc)
+
+	return svc, nil
+}
+
+func (s *Server) getPort(port int) *Service {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.ports[port]
+}
+
+// hasService 返回 name 是否是当前 listen 并劫持的服务
+func (s *Server) hasService(name string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, svc := range s.ports {
+		if svc.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) hijackService(ctx context.Context, serviceName string, port int) error {
+	if s.operator == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return s.operator.HijackService(ctx, serviceName, s.conf.AppName, port)
+}
+
+// revokeToken 回收 token 并关闭服务，notice 不为 nil 时会先通知已连接的 agent
+func (s *Server) revokeToken(ctx context.Context, token string, restore bool, notice *proto.Revoked) error {
+	slog.Info("revoke token", "token", token)
+
+	s.lock.Lock()
+	svc := s.tokens[token]
+	if svc != nil {
+		delete(s.tokens, token)
+		delete(s.ports, svc.port)
+	}
+	s.lock.Unlock()
+	if svc == nil {
+		slog.Debug("invalid token", "token", token)
+		return nil
+	}
+
+	if s.operator != nil && restore {
+		slog.Info("restore service", "name", svc.name)
+
+		ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		err := s.operator.RestoreService(ctx, svc.name)
+		cancel()
+		if err != nil {
+			slog.Warn("restore service", "name", svc.name)
+		}
+	}
+
+	slog.Info("close service", "name", svc.name, "token", svc.token)
+
+	svc.close(notice)
+
+	return nil
+}
+
+func (s *Server) handleAgentConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	svc, hello, err := s.shakeHandsWithAgent(conn)
+	if err != nil {
+		slog.Debug("agent shake hands", "conn", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+
+	var (
+		lc net.Conn = conn
+		fc *ioutil.FlateConn
+	)
+	if hello.Capabilities.Has(proto.CapCompression) {
+		fc = ioutil.NewFlateConn(conn)
+		lc = fc
+	}
+	ac := s.newAgentConn(svc, lc, hello.Capabilities)
+	defer ac.Close()
+	if svc != nil {
+		slog.Debug("service add agent connection", "name", svc.name, "conn", conn.RemoteAddr().String(), "version", hello.Version, "agent", hello.BinaryVersion, "caps", hello.Capabilities)
+
+		if !svc.addAgentConn(ac) {
+			return
+		}
+	} else {
+		slog.Debug("new agent session", "conn", conn.RemoteAddr().String(), "version", hello.Version, "agent", hello.BinaryVersion, "caps", hello.Capabilities)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		ac.Close()
+	})
+	defer stop()
+
+	if ac.hasControl() {
+		go s.serveControl(ac)
+	}
+
+	err = ac.LastErr()
+	close(ac.done)
+	if err != nil && err != io.EOF {
+		slog.Error("agent connection error", "conn", conn.RemoteAddr().String(), "err", err)
+	}
+	if fc != nil {
+		st := fc.Stats()
+		slog.Info("agent connection compression", "conn", conn.RemoteAddr().String(), "rawIn", st.RawIn, "wireIn", st.WireIn, "inRatio", st.InRatio(),
+			"rawOut", st.RawOut, "wireOut", st.WireOut, "outRatio", st.OutRatio())
+	}
+	ac.removeFromService()
+}
+
+func (s *Server) lookupToken(token string) *Service {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.tokens[token]
+}
+
+// shakeHandsWithLegacyAgent 处理只支持 v1 消息的旧版本 agent
+func (s *Server) shakeHandsWithLegacyAgent(rd io.Reader, conn net.Conn) (*Service, *proto.Hello, error) {
+	cmd, token, err := proto.ReadMessage(rd)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cmd != proto.CmdShakeHands {
+		return nil, nil, errBadShakeHands
+	}
+
+	svc := s.lookupToken(token)
+
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if svc == nil {
+		_ = proto.WriteMessage(conn, proto.CmdError, "invalid token")
+	} else {
+		_ = proto.WriteMessage(conn, proto.CmdShakeHandsOk, "ok")
+	}
+	conn.SetWriteDeadline(time.Time{})
+	if svc == nil {
+		return nil, nil, errInvalidToken
+	}
+
+	return svc, &proto.Hello{Version: 1}, nil
+}
+
+// shakeHandsWithAgent 返回 token 对应的服务，不绑定 token 的会话返回 nil
+func (s *Server) shakeHandsWithAgent(conn net.Conn) (*Service, *proto.Hello, error) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var magic [1]byte
+	_, err := io.ReadFull(conn, magic[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if magic[0] != proto.FrameMagic {
+		return s.shakeHandsWithLegacyAgent(io.MultiReader(bytes.NewReader(magic[:]), conn), conn)
+	}
+
+	msg, err := proto.ReadFrame(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	peer, ok := msg.(*proto.Hello)
+	if !ok {
+		return nil, nil, errBadShakeHands
+	}
+
+	var svc *Service
+	hello, err := proto.Negotiate(&proto.Hello{
+		Version:       proto.ProtocolVersion,
+		BinaryVersion: proto.BinaryVersion,
+		Capabilities:  s.capabilities(),
+	}, peer)
+	if err == nil {
+		if peer.Token != "" {
+			svc = s.lookupToken(peer.Token)
+			if svc == nil {
+				err = errInvalidToken
+			}
+		} else if s.conf.APIKey != "" && peer.APIKey != s.conf.APIKey {
+			// 不绑定 token 的会话使用 API key 认证
+			err = errUnauthorized
+		}
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		_ = proto.WriteFrame(conn, &proto.Error{Message: err.Error()})
+	} else {
+		_ = proto.WriteFrame(conn, &proto.HelloOk{Hello: proto.Hello{
+			Version:       hello.Version,
+			BinaryVersion: proto.BinaryVersion,
+			Capabilities:  hello.Capabilities,
+		}})
+	}
+	conn.SetWriteDeadline(time.Time{})
+
+	return svc, hello, err
+}
+
+// ServeLink 在 ln 上接受 agent 连接，ctx 结束后关闭 ln 和所有 agent 连接
+func (s *Server) ServeLink(ctx context.Context, ln net.Listener) error {
+	stop := context.AfterFunc(ctx, func() {
+		ln.Close()
+	})
+	defer stop()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			slog.Warn("accept agent connection", "err", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		slog.Debug("new agent connection", "conn", conn.RemoteAddr().String())
+
+		go s.handleAgentConn(ctx, conn)
+	}
+}
+
+// Shutdown 回收所有 token 并还原被劫持的 Service
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.RLock()
+	tokens := make([]string, 0, len(s.tokens))
+	for token := range s.tokens {
+		tokens = append(tokens, token)
+	}
+	s.lock.RUnlock()
+
+	var errs []error
+	for _, token := range tokens {
+		err := s.revokeToken(ctx, token, true, &proto.Revoked{
+			Reason: "expose shutting down",
+			By:     cmp.Or(s.conf.AppName, "ksrp-expose"),
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// link 端口上的连接在 ServeLink 的 ctx 取消时结束，API 端口上的连接在这里结束
+	s.cancelAPILinks()
+	return errors.Join(errs...)
+}
+
+// apiLinkContext 返回 API 端口上的 agent 连接使用的 context，parent 结束或者 Shutdown 时取消
+func (s *Server) apiLinkContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	stop := context.AfterFunc(s.apiLinks, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// NewServer 创建 expose 服务，kc 和 operator 为 nil 时不访问 Kubernetes
+func NewServer(conf *Config, kc *kube.Client, operator *kube.ExposeOperator) (*Server, error) {
+	dialRules, err := parseDialRules(conf.DialAllow)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		conf:      *conf,
+		kc:        kc,
+		operator:  operator,
+		dialRules: dialRules,
+		ports:     make(map[int]*Service),
+		tokens:    make(map[string]*Service),
+	}
+	s.apiLinks, s.cancelAPILinks = context.WithCancel(context.Background())
+	s.conf.setDefaults()
+	if s.conf.ConnLimitMode != LimitReject && s.conf.ConnLimitMode != LimitQueue {
+		return nil, fmt.Errorf("invalid conn limit mode %q", s.conf.ConnLimitMode)
+	}
+	s.limiter = newConnLimiter(s.conf.MaxConns)
+	if s.conf.ConnLimitMode == LimitQueue {
+		s.queue = make(chan struct{}, s.conf.ConnQueueSize)
+	}
+	s.bandwidthIn = newBandwidthLimiter(s.conf.BandwidthIn)
+	s.bandwidthOut = newBandwidthLimiter(s.conf.BandwidthOut)
+	if s.conf.AccessLog != "" {
+		s.accessLog, err = newAccessLogger(s.conf.AccessLog, s.conf.AccessLogMaxSize, s.conf.AccessLogMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,303 @@
+package expose
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/vizee/ksrp/proto"
+	"github.com/vizee/mstp"
+)
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func listenService(t *testing.T, api string, service string, port int) string {
+	t.Helper()
+	resp, err := http.PostForm(api+"/expose/listen", url.Values{
+		"service": {service},
+		"port":    {strconv.Itoa(port)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("listen: %s: %s", resp.Status, body)
+	}
+	return string(body)
+}
+
+// linkEchoAgent 以 agent 的身份建立 link，把每个流上收到的数据原样写回
+func linkEchoAgent(t *testing.T, address string, token string) *mstp.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shakeHandsEchoAgent(t, conn, token)
+}
+
+// upgradeLink 在 API 端口上通过 Upgrade 建立 link 使用的连接
+func upgradeLink(t *testing.T, api string) net.Conn {
+	t.Helper()
+	u, err := url.Parse(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.WriteString(conn, "GET /expose/link HTTP/1.1\r\nHost: "+u.Host+"\r\nConnection: Upgrade\r\nUpgrade: "+proto.LinkUpgrade+"\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 响应头之后服务端等待 agent 先发送数据，逐字节读取不会读到 link 的数据
+	resp, err := http.ReadResponse(bufio.NewReaderSize(iotest.OneByteReader(conn), 16), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade link: %s", resp.Status)
+	}
+	return conn
+}
+
+func shakeHandsEchoAgent(t *testing.T, conn net.Conn, token string) *mstp.Conn {
+	t.Helper()
+	_, err := conn.Write([]byte{proto.FrameMagic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = proto.WriteFrame(conn, &proto.Hello{Version: proto.ProtocolVersion, Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := proto.ReadFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*proto.HelloOk); !ok {
+		t.Fatalf("unexpected hello response: %v", msg)
+	}
+	return mstp.NewConn(conn, conn, false, func(s *mstp.Stream) {
+		go func() {
+			defer s.Close()
+			io.Copy(s, s)
+		}()
+	})
+}
+
+func waitAgentConn(t *testing.T, s *Server, token string) {
+	t.Helper()
+	svc := s.lookupToken(token)
+	if svc == nil {
+		t.Fatal("service not found")
+	}
+	for range 100 {
+		svc.lock.Lock()
+		n := len(svc.acs)
+		svc.lock.Unlock()
+		if n != 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("agent connection is not added to service")
+}
+
+func TestServeLink(t *testing.T) {
+	s, err := NewServer(&Config{ServiceHost: "127.0.0.1"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(s.Handler())
+	defer api.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- s.ServeLink(ctx, ln)
+	}()
+
+	port := freePort(t)
+	token := listenService(t, api.URL, "echo", port)
+	msc := linkEchoAgent(t, ln.Addr().String(), token)
+	defer msc.Close()
+	waitAgentConn(t, s, token)
+
+	sc, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	sc.SetDeadline(time.Now().Add(5 * time.Second))
+	want := "hello through expose"
+	_, err = sc.Write([]byte(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	_, err = io.ReadFull(sc, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("ServeLink returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeLink does not return after cancel")
+	}
+	linkClosed := make(chan error, 1)
+	go func() {
+		linkClosed <- msc.LastErr()
+	}()
+	select {
+	case <-linkClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent link is not closed after cancel")
+	}
+
+	err = s.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.getPort(port) != nil {
+		t.Fatal("service is not revoked after shutdown")
+	}
+}
+
+func TestShutdownClosesAPILinks(t *testing.T) {
+	s, err := NewServer(&Config{ServiceHost: "127.0.0.1"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(s.Handler())
+	defer api.Close()
+
+	// 不绑定 token 的会话不会被回收 token 时关闭
+	msc := shakeHandsEchoAgent(t, upgradeLink(t, api.URL), "")
+	defer msc.Close()
+
+	err = s.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkClosed := make(chan error, 1)
+	go func() {
+		linkClosed <- msc.LastErr()
+	}()
+	select {
+	case <-linkClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent link on API port is not closed after shutdown")
+	}
+}
+
+func TestLegacyAgent(t *testing.T) {
+	s, err := NewServer(&Config{ServiceHost: "127.0.0.1"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(s.Handler())
+	defer api.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.ServeLink(ctx, ln)
+
+	port := freePort(t)
+	token := listenService(t, api.URL, "legacy", port)
+
+	// v1 agent 直接发送 CmdShakeHands，不发送 FrameMagic
+	shakeHands := func(token string) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = proto.WriteMessage(conn, proto.CmdShakeHands, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		cmd, _, err := proto.ReadMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Time{})
+		return conn, cmd
+	}
+
+	conn, cmd := shakeHands("invalid")
+	conn.Close()
+	if cmd != proto.CmdError {
+		t.Fatalf("invalid token: got command %#x", cmd)
+	}
+
+	conn, cmd = shakeHands(token)
+	if cmd != proto.CmdShakeHandsOk {
+		t.Fatalf("got command %#x", cmd)
+	}
+	msc := mstp.NewConn(conn, conn, false, func(s *mstp.Stream) {
+		go func() {
+			defer s.Close()
+			io.Copy(s, s)
+		}()
+	})
+	defer msc.Close()
+	waitAgentConn(t, s, token)
+
+	sc, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	sc.SetDeadline(time.Now().Add(5 * time.Second))
+	want := "hello from v1 agent"
+	_, err = io.WriteString(sc, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	_, err = io.ReadFull(sc, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	s.Shutdown(context.Background())
+}
@@ -0,0 +1,47 @@
+package expose
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+type httpAddr string
+
+func (a httpAddr) Network() string {
+	return "tcp"
+}
+
+func (a httpAddr) String() string {
+	return string(a)
+}
+
+// wsConn 是通过 WebSocket 建立的 agent 连接，服务端 websocket.Conn 的 RemoteAddr 返回的是 Origin，需要替换为客户端地址
+type wsConn struct {
+	*websocket.Conn
+	remote net.Addr
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// linkWebSocket 在 API 服务上接受通过 WebSocket 建立的 agent 连接，用于无法直接访问 link 端口的环境
+func (s *Server) linkWebSocket() http.Handler {
+	return websocket.Server{
+		// agent 不是浏览器，不检查 Origin
+		Handshake: func(*websocket.Config, *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			r := ws.Request()
+			slog.Debug("new agent websocket connection", "conn", r.RemoteAddr)
+			ctx, cancel := s.apiLinkContext(r.Context())
+			defer cancel()
+			s.handleAgentConn(ctx, &wsConn{Conn: ws, remote: httpAddr(r.RemoteAddr)})
+		},
+	}
+}
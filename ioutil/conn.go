@@ -0,0 +1,24 @@
+package ioutil
+
+import (
+	"bufio"
+	"net"
+)
+
+// BufferedConn 先读取 br 中缓冲的数据，用于读取过 HTTP 头等内容后的连接
+type BufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *BufferedConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+// NewBufferedConn 在 br 中没有缓冲数据时直接返回 conn
+func NewBufferedConn(conn net.Conn, br *bufio.Reader) net.Conn {
+	if br.Buffered() == 0 {
+		return conn
+	}
+	return &BufferedConn{Conn: conn, br: br}
+}
@@ -0,0 +1,113 @@
+package ioutil
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+type countingReader struct {
+	io.Reader
+	n   atomic.Int64
+	eof bool
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n.Add(int64(n))
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+type countingWriter struct {
+	io.Writer
+	n atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
+
+// FlateConn 使用 deflate 压缩连接上的数据，每次写入后都会 flush，适合上层已经做了写合并的场景
+type FlateConn struct {
+	net.Conn
+	r      io.ReadCloser
+	w      *flate.Writer
+	wireR  *countingReader
+	wireW  *countingWriter
+	rawIn  atomic.Int64
+	rawOut atomic.Int64
+}
+
+func (c *FlateConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.rawIn.Add(int64(n))
+	if err == io.ErrUnexpectedEOF && c.wireR.eof {
+		// 每次写入都会 flush 但不会写结束块，对端关闭连接时视为正常结束
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (c *FlateConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.rawOut.Add(int64(n))
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+// FlateStats 是压缩前后的字节数，Raw 是压缩前，Wire 是连接上实际传输的
+type FlateStats struct {
+	RawIn   int64
+	WireIn  int64
+	RawOut  int64
+	WireOut int64
+}
+
+func ratio(raw int64, wire int64) string {
+	if wire == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f", float64(raw)/float64(wire))
+}
+
+// InRatio 返回接收方向的压缩比
+func (s FlateStats) InRatio() string {
+	return ratio(s.RawIn, s.WireIn)
+}
+
+// OutRatio 返回发送方向的压缩比
+func (s FlateStats) OutRatio() string {
+	return ratio(s.RawOut, s.WireOut)
+}
+
+func (c *FlateConn) Stats() FlateStats {
+	return FlateStats{
+		RawIn:   c.rawIn.Load(),
+		WireIn:  c.wireR.n.Load(),
+		RawOut:  c.rawOut.Load(),
+		WireOut: c.wireW.n.Load(),
+	}
+}
+
+func NewFlateConn(conn net.Conn) *FlateConn {
+	wireR := &countingReader{Reader: conn}
+	wireW := &countingWriter{Writer: conn}
+	// 链路上以交互流量为主，优先考虑速度
+	w, _ := flate.NewWriter(wireW, flate.BestSpeed)
+	return &FlateConn{
+		Conn:  conn,
+		r:     flate.NewReader(wireR),
+		w:     w,
+		wireR: wireR,
+		wireW: wireW,
+	}
+}
@@ -43,6 +43,14 @@ func (c *Client) Get(ctx context.Context, gvk schema.GroupVersionKind, ns string
 	return ri.Get(ctx, name, metav1.GetOptions{})
 }
 
+func (c *Client) List(ctx context.Context, gvk schema.GroupVersionKind, ns string, opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	ri, err := c.resourceInterface(gvk, ns)
+	if err != nil {
+		return nil, err
+	}
+	return ri.List(ctx, opts)
+}
+
 func (c *Client) Create(ctx context.Context, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
 	ri, err := c.resourceInterface(obj.GroupVersionKind(), obj.GetNamespace())
 	if err != nil {
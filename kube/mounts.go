@@ -0,0 +1,204 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const defaultVolumeMode = 0644
+
+// MountFile 是挂载到容器中的一个文件，Path 是容器内的绝对路径
+type MountFile struct {
+	Path string `json:"path"`
+	Mode int64  `json:"mode"`
+	Data []byte `json:"data"`
+}
+
+// volumeFile 是卷中的一个文件，path 相对于卷的根目录
+type volumeFile struct {
+	path string
+	mode int64
+	data []byte
+}
+
+// projectFiles 按照 items 把对象的数据投射为文件，items 为空时每个 key 一个文件
+func (s *objectSource) projectFiles(ctx context.Context, gvk schema.GroupVersionKind, ref map[string]any, name string, defaultMode int64) ([]volumeFile, error) {
+	optional, _, _ := unstructured.NestedBool(ref, "optional")
+	od, err := s.loadObject(ctx, gvk, name)
+	if err != nil {
+		if optional && apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	items, _, _ := unstructured.NestedSlice(ref, "items")
+	if len(items) == 0 {
+		files := make([]volumeFile, 0, len(od.data))
+		for k, v := range od.data {
+			files = append(files, volumeFile{path: k, mode: defaultMode, data: v})
+		}
+		return files, nil
+	}
+
+	files := make([]volumeFile, 0, len(items))
+	for _, item := range items {
+		kp, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		key, _, _ := unstructured.NestedString(kp, "key")
+		p, _, _ := unstructured.NestedString(kp, "path")
+		data, ok := od.data[key]
+		if !ok {
+			if optional {
+				continue
+			}
+			return nil, fmt.Errorf("%s %s has no key %s", strings.ToLower(gvk.Kind), name, key)
+		}
+		mode, ok, _ := unstructured.NestedInt64(kp, "mode")
+		if !ok {
+			mode = defaultMode
+		}
+		files = append(files, volumeFile{path: p, mode: mode, data: data})
+	}
+	return files, nil
+}
+
+// volumeFiles 返回卷中的文件，只支持 configMap、secret 以及由它们组成的 projected 卷
+func (s *objectSource) volumeFiles(ctx context.Context, volume map[string]any) ([]volumeFile, error) {
+	if ref, ok := volume["configMap"].(map[string]any); ok {
+		name, _, _ := unstructured.NestedString(ref, "name")
+		mode, ok, _ := unstructured.NestedInt64(ref, "defaultMode")
+		if !ok {
+			mode = defaultVolumeMode
+		}
+		return s.projectFiles(ctx, configMapGVK, ref, name, mode)
+	}
+	if ref, ok := volume["secret"].(map[string]any); ok {
+		name, _, _ := unstructured.NestedString(ref, "secretName")
+		mode, ok, _ := unstructured.NestedInt64(ref, "defaultMode")
+		if !ok {
+			mode = defaultVolumeMode
+		}
+		return s.projectFiles(ctx, secretGVK, ref, name, mode)
+	}
+	if projected, ok := volume["projected"].(map[string]any); ok {
+		mode, ok, _ := unstructured.NestedInt64(projected, "defaultMode")
+		if !ok {
+			mode = defaultVolumeMode
+		}
+		sources, _, _ := unstructured.NestedSlice(projected, "sources")
+		var files []volumeFile
+		for _, item := range sources {
+			source, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			var (
+				sourceFiles []volumeFile
+				err         error
+			)
+			if ref, ok := source["configMap"].(map[string]any); ok {
+				name, _, _ := unstructured.NestedString(ref, "name")
+				sourceFiles, err = s.projectFiles(ctx, configMapGVK, ref, name, mode)
+			} else if ref, ok := source["secret"].(map[string]any); ok {
+				name, _, _ := unstructured.NestedString(ref, "name")
+				sourceFiles, err = s.projectFiles(ctx, secretGVK, ref, name, mode)
+			} else {
+				// serviceAccountToken、downwardAPI 等依赖 pod 运行时信息
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, sourceFiles...)
+		}
+		return files, nil
+	}
+	return nil, fmt.Errorf("unsupported volume type")
+}
+
+// ResolveMounts 解析容器挂载的 ConfigMap 和 Secret 卷，无法解析的挂载会记录在 skipped 中
+func (c *Client) ResolveMounts(ctx context.Context, namespace string, podSpec map[string]any, container map[string]any, allowSecrets bool) (files []MountFile, skipped []string, err error) {
+	src := newObjectSource(c, namespace, allowSecrets)
+
+	volumes := make(map[string]map[string]any)
+	volumeList, _, _ := unstructured.NestedSlice(podSpec, "volumes")
+	for _, item := range volumeList {
+		volume, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(volume, "name")
+		volumes[name] = volume
+	}
+
+	mounts, _, _ := unstructured.NestedSlice(container, "volumeMounts")
+	for _, item := range mounts {
+		mount, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(mount, "name")
+		mountPath, _, _ := unstructured.NestedString(mount, "mountPath")
+		subPath, _, _ := unstructured.NestedString(mount, "subPath")
+
+		volume, ok := volumes[name]
+		if !ok {
+			skipped = append(skipped, fmt.Sprintf("%s: volume %s not found", mountPath, name))
+			continue
+		}
+		volFiles, err := src.volumeFiles(ctx, volume)
+		if err != nil {
+			skipped = append(skipped, fmt.Sprintf("%s: volume %s: %v", mountPath, name, err))
+			continue
+		}
+
+		for _, f := range volFiles {
+			p := path.Clean("/" + f.path)
+			if subPath != "" {
+				// subPath 只挂载卷中的一个文件或子目录
+				sub := path.Clean("/" + subPath)
+				if p != sub && !strings.HasPrefix(p, sub+"/") {
+					continue
+				}
+				p = strings.TrimPrefix(p, sub)
+			}
+			files = append(files, MountFile{
+				Path: path.Join(mountPath, p),
+				Mode: f.mode,
+				Data: f.data,
+			})
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files, skipped, nil
+}
+
+// ServiceMounts 解析 Service 原来选择的 Deployment 中容器挂载的文件
+func (o *ExposeOperator) ServiceMounts(ctx context.Context, serviceName string, containerName string, allowSecrets bool) ([]MountFile, []string, error) {
+	deploy, err := o.FindDeployment(ctx, serviceName)
+	if err != nil {
+		return nil, nil, err
+	}
+	container, err := PodTemplateContainer(deploy, containerName)
+	if err != nil {
+		return nil, nil, err
+	}
+	podSpec, _, err := unstructured.NestedMap(deploy.Object, "spec", "template", "spec")
+	if err != nil {
+		return nil, nil, err
+	}
+	return o.kc.ResolveMounts(ctx, o.namespace, podSpec, container, allowSecrets)
+}
@@ -0,0 +1,54 @@
+package kube
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+type ServicePort struct {
+	Name     string `json:"name,omitempty"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+type ServiceInfo struct {
+	Name      string        `json:"name"`
+	Namespace string        `json:"namespace"`
+	ClusterIP string        `json:"clusterIP,omitempty"`
+	Ports     []ServicePort `json:"ports"`
+}
+
+// ListServices 列出 namespace 下所有 Service 及其端口
+func (c *Client) ListServices(ctx context.Context, namespace string) ([]ServiceInfo, error) {
+	list, err := c.List(ctx, serviceGVK, namespace, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	services := make([]ServiceInfo, 0, len(list.Items))
+	for _, item := range list.Items {
+		info := ServiceInfo{
+			Name:      item.GetName(),
+			Namespace: item.GetNamespace(),
+		}
+		info.ClusterIP, _, _ = unstructured.NestedString(item.Object, "spec", "clusterIP")
+		ports, _, _ := unstructured.NestedSlice(item.Object, "spec", "ports")
+		for _, p := range ports {
+			pm, ok := p.(map[string]any)
+			if !ok {
+				continue
+			}
+			port, _, _ := unstructured.NestedInt64(pm, "port")
+			name, _, _ := unstructured.NestedString(pm, "name")
+			protocol, _, _ := unstructured.NestedString(pm, "protocol")
+			info.Ports = append(info.Ports, ServicePort{
+				Name:     name,
+				Port:     int(port),
+				Protocol: protocol,
+			})
+		}
+		services = append(services, info)
+	}
+	return services, nil
+}
@@ -0,0 +1,350 @@
+package kube
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	deploymentGVK = schema.GroupVersionKind{
+		Group:   "apps",
+		Version: "v1",
+		Kind:    "Deployment",
+	}
+	configMapGVK = schema.GroupVersionKind{
+		Version: "v1",
+		Kind:    "ConfigMap",
+	}
+	secretGVK = schema.GroupVersionKind{
+		Version: "v1",
+		Kind:    "Secret",
+	}
+)
+
+var (
+	ErrNoWorkload  = errors.New("no workload selected by service")
+	ErrNoContainer = errors.New("container not found")
+)
+
+type EnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// originalSelector 返回 Service 被劫持前的 selector
+func (o *ExposeOperator) originalSelector(obj *unstructured.Unstructured) (map[string]string, error) {
+	annotations := obj.GetAnnotations()
+	if annotations[hijackAnnotation] != "true" {
+		selector, _, err := unstructured.NestedStringMap(obj.Object, "spec", "selector")
+		return selector, err
+	}
+
+	specData, ok := annotations[defaultSpecAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var defaultSpec struct {
+		Selector map[string]string `json:"selector"`
+	}
+	err := json.Unmarshal([]byte(specData), &defaultSpec)
+	if err != nil {
+		return nil, err
+	}
+	return defaultSpec.Selector, nil
+}
+
+// FindDeployment 返回 Service 原来选择的 Deployment
+func (o *ExposeOperator) FindDeployment(ctx context.Context, serviceName string) (*unstructured.Unstructured, error) {
+	obj, err := o.kc.Get(ctx, serviceGVK, o.namespace, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	selector, err := o.originalSelector(obj)
+	if err != nil {
+		return nil, err
+	}
+	if len(selector) == 0 {
+		return nil, ErrNoWorkload
+	}
+
+	list, err := o.kc.List(ctx, deploymentGVK, o.namespace, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	sel := labels.SelectorFromSet(selector)
+	for i := range list.Items {
+		deploy := &list.Items[i]
+		podLabels, _, _ := unstructured.NestedStringMap(deploy.Object, "spec", "template", "metadata", "labels")
+		if sel.Matches(labels.Set(podLabels)) {
+			return deploy, nil
+		}
+	}
+	return nil, ErrNoWorkload
+}
+
+// PodTemplateContainer 返回 Deployment pod 模板中的容器，name 为空时返回第一个容器
+func PodTemplateContainer(deploy *unstructured.Unstructured, name string) (map[string]any, error) {
+	containers, _, err := unstructured.NestedSlice(deploy.Object, "spec", "template", "spec", "containers")
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range containers {
+		container, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		if name == "" || container["name"] == name {
+			return container, nil
+		}
+	}
+	return nil, ErrNoContainer
+}
+
+// objectData 是 ConfigMap 或 Secret 解码后的数据
+type objectData struct {
+	data map[string][]byte
+	// binary 记录来自 ConfigMap binaryData 的 key
+	binary map[string]bool
+}
+
+// objectSource 读取 ConfigMap 和 Secret 的数据，并缓存同一次解析中的结果
+type objectSource struct {
+	kc           *Client
+	namespace    string
+	allowSecrets bool
+	cache        map[string]*objectData
+}
+
+func newObjectSource(kc *Client, namespace string, allowSecrets bool) *objectSource {
+	return &objectSource{
+		kc:           kc,
+		namespace:    namespace,
+		allowSecrets: allowSecrets,
+		cache:        make(map[string]*objectData),
+	}
+}
+
+func (s *objectSource) loadObject(ctx context.Context, gvk schema.GroupVersionKind, name string) (*objectData, error) {
+	key := gvk.Kind + "/" + name
+	if od, ok := s.cache[key]; ok {
+		return od, nil
+	}
+	if gvk == secretGVK && !s.allowSecrets {
+		return nil, fmt.Errorf("secret %s: reading secrets is not allowed", name)
+	}
+
+	obj, err := s.kc.Get(ctx, gvk, s.namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	plain, _, err := unstructured.NestedStringMap(obj.Object, "data")
+	if err != nil {
+		return nil, err
+	}
+	encoded := plain
+	if gvk == configMapGVK {
+		encoded, _, err = unstructured.NestedStringMap(obj.Object, "binaryData")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	od := &objectData{
+		data:   make(map[string][]byte, len(plain)+len(encoded)),
+		binary: make(map[string]bool),
+	}
+	if gvk != secretGVK {
+		for k, v := range plain {
+			od.data[k] = []byte(v)
+		}
+	}
+	for k, v := range encoded {
+		decoded, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s key %s: %w", strings.ToLower(gvk.Kind), name, k, err)
+		}
+		od.data[k] = decoded
+		if gvk == configMapGVK {
+			od.binary[k] = true
+		}
+	}
+	s.cache[key] = od
+	return od, nil
+}
+
+// load 返回可以作为环境变量的数据，kubelet 不会把 ConfigMap 的 binaryData 导入环境变量
+func (s *objectSource) load(ctx context.Context, gvk schema.GroupVersionKind, name string) (map[string]string, error) {
+	od, err := s.loadObject(ctx, gvk, name)
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string, len(od.data))
+	for k, v := range od.data {
+		if !od.binary[k] {
+			vars[k] = string(v)
+		}
+	}
+	return vars, nil
+}
+
+func (s *objectSource) loadKey(ctx context.Context, gvk schema.GroupVersionKind, ref map[string]any) (string, bool, error) {
+	name, _, _ := unstructured.NestedString(ref, "name")
+	key, _, _ := unstructured.NestedString(ref, "key")
+	optional, _, _ := unstructured.NestedBool(ref, "optional")
+	data, err := s.load(ctx, gvk, name)
+	if err != nil {
+		if optional && apierrors.IsNotFound(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	value, ok := data[key]
+	if !ok && !optional {
+		return "", false, fmt.Errorf("%s %s has no key %s", strings.ToLower(gvk.Kind), name, key)
+	}
+	return value, ok, nil
+}
+
+// expandEnv 展开 $(VAR) 引用，规则和 kubelet 一致：$$ 转义，未定义的引用保持原样
+func expandEnv(value string, vars map[string]string) string {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '$' || i+1 >= len(value) {
+			sb.WriteByte(value[i])
+			continue
+		}
+		switch value[i+1] {
+		case '$':
+			sb.WriteByte('$')
+			i++
+		case '(':
+			end := strings.IndexByte(value[i+2:], ')')
+			if end < 0 {
+				sb.WriteString(value[i:])
+				return sb.String()
+			}
+			name := value[i+2 : i+2+end]
+			if v, ok := vars[name]; ok {
+				sb.WriteString(v)
+			} else {
+				sb.WriteString(value[i : i+3+end])
+			}
+			i += 2 + end
+		default:
+			sb.WriteByte('$')
+		}
+	}
+	return sb.String()
+}
+
+// ResolveEnv 解析容器的 env 和 envFrom，无法解析的变量会记录在 skipped 中
+func (c *Client) ResolveEnv(ctx context.Context, namespace string, container map[string]any, allowSecrets bool) (env []EnvVar, skipped []string, err error) {
+	src := newObjectSource(c, namespace, allowSecrets)
+	vars := make(map[string]string)
+	index := make(map[string]int)
+	set := func(name string, value string) {
+		vars[name] = value
+		if i, ok := index[name]; ok {
+			env[i].Value = value
+			return
+		}
+		index[name] = len(env)
+		env = append(env, EnvVar{Name: name, Value: value})
+	}
+
+	// envFrom 先于 env，env 中的同名变量会覆盖 envFrom
+	envFrom, _, _ := unstructured.NestedSlice(container, "envFrom")
+	for _, item := range envFrom {
+		from, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		prefix, _, _ := unstructured.NestedString(from, "prefix")
+		var (
+			gvk schema.GroupVersionKind
+			ref map[string]any
+		)
+		if r, ok := from["configMapRef"].(map[string]any); ok {
+			gvk, ref = configMapGVK, r
+		} else if r, ok := from["secretRef"].(map[string]any); ok {
+			gvk, ref = secretGVK, r
+		} else {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(ref, "name")
+		optional, _, _ := unstructured.NestedBool(ref, "optional")
+		data, err := src.load(ctx, gvk, name)
+		if err != nil {
+			if !(optional && apierrors.IsNotFound(err)) {
+				skipped = append(skipped, err.Error())
+			}
+			continue
+		}
+		for k, v := range data {
+			set(prefix+k, v)
+		}
+	}
+
+	envList, _, _ := unstructured.NestedSlice(container, "env")
+	for _, item := range envList {
+		ev, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(ev, "name")
+		valueFrom, ok := ev["valueFrom"].(map[string]any)
+		if !ok {
+			value, _, _ := unstructured.NestedString(ev, "value")
+			set(name, expandEnv(value, vars))
+			continue
+		}
+
+		var (
+			value string
+			found bool
+			err   error
+		)
+		if ref, ok := valueFrom["configMapKeyRef"].(map[string]any); ok {
+			value, found, err = src.loadKey(ctx, configMapGVK, ref)
+		} else if ref, ok := valueFrom["secretKeyRef"].(map[string]any); ok {
+			value, found, err = src.loadKey(ctx, secretGVK, ref)
+		} else if ref, ok := valueFrom["fieldRef"].(map[string]any); ok && ref["fieldPath"] == "metadata.namespace" {
+			value, found = namespace, true
+		} else {
+			// 依赖 pod 运行时信息的变量无法在本地还原
+			err = fmt.Errorf("%s: unsupported valueFrom", name)
+		}
+		if err != nil {
+			skipped = append(skipped, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		if found {
+			set(name, value)
+		}
+	}
+
+	return env, skipped, nil
+}
+
+// ServiceEnv 解析 Service 原来选择的 Deployment 中容器的环境变量
+func (o *ExposeOperator) ServiceEnv(ctx context.Context, serviceName string, containerName string, allowSecrets bool) ([]EnvVar, []string, error) {
+	deploy, err := o.FindDeployment(ctx, serviceName)
+	if err != nil {
+		return nil, nil, err
+	}
+	container, err := PodTemplateContainer(deploy, containerName)
+	if err != nil {
+		return nil, nil, err
+	}
+	return o.kc.ResolveEnv(ctx, o.namespace, container, allowSecrets)
+}
@@ -0,0 +1,185 @@
+package proto
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MsgOpenStream   MessageType = 4
+	MsgPing         MessageType = 5
+	MsgPong         MessageType = 6
+	MsgRevoked      MessageType = 7
+	MsgOpenStreamOk MessageType = 8
+	// MsgStreamMetadata 是 expose 打开的流上的第一帧，需要协商 CapStreamMetadata
+	MsgStreamMetadata MessageType = 9
+)
+
+const (
+	// StreamControl 是 agent 打开的控制流，用于 keepalive 等控制消息
+	StreamControl = "control"
+	// StreamDial 要求 expose 连接 Address，成功后流上转发原始数据
+	StreamDial = "dial"
+)
+
+var (
+	ErrKeepaliveTimeout = errors.New("keepalive timeout")
+)
+
+// OpenStream 是 agent 主动打开的流上的第一帧，说明流的用途
+type OpenStream struct {
+	Kind    string `json:"kind"`
+	Address string `json:"address,omitempty"`
+}
+
+func (*OpenStream) Type() MessageType {
+	return MsgOpenStream
+}
+
+// OpenStreamOk 是 expose 对 StreamDial 的成功回复，失败时回复 Error
+type OpenStreamOk struct{}
+
+func (*OpenStreamOk) Type() MessageType {
+	return MsgOpenStreamOk
+}
+
+// StreamMetadata 描述 expose 打开的流对应的服务连接，之后流上转发原始数据
+type StreamMetadata struct {
+	// ClientAddr 是连接服务端口的客户端地址
+	ClientAddr string `json:"clientAddr"`
+	// DestAddr 是客户端连接的服务地址
+	DestAddr string `json:"destAddr"`
+}
+
+func (*StreamMetadata) Type() MessageType {
+	return MsgStreamMetadata
+}
+
+type Ping struct {
+	Seq uint64 `json:"seq"`
+}
+
+func (*Ping) Type() MessageType {
+	return MsgPing
+}
+
+type Pong struct {
+	Seq uint64 `json:"seq"`
+}
+
+func (*Pong) Type() MessageType {
+	return MsgPong
+}
+
+// Revoked 通知 agent token 已经被回收，agent 不应该再重连
+type Revoked struct {
+	Reason string `json:"reason"`
+	By     string `json:"by"`
+}
+
+func (*Revoked) Type() MessageType {
+	return MsgRevoked
+}
+
+func (r *Revoked) Error() string {
+	return fmt.Sprintf("token revoked by %s: %s", cmp.Or(r.By, "unknown"), cmp.Or(r.Reason, "no reason"))
+}
+
+// ControlStream 在一个流上收发控制消息
+type ControlStream struct {
+	rw       io.ReadWriteCloser
+	wlock    sync.Mutex
+	lastRecv atomic.Int64
+}
+
+func (c *ControlStream) Send(msg Message) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return WriteFrame(c.rw, msg)
+}
+
+func (c *ControlStream) Close() error {
+	return c.rw.Close()
+}
+
+func (c *ControlStream) readMessages(handle func(Message)) error {
+	for {
+		msg, err := ReadFrame(c.rw)
+		if err != nil {
+			if errors.Is(err, ErrUnknownMessage) {
+				// 忽略新版本对端发送的未知消息
+				continue
+			}
+			return err
+		}
+		c.lastRecv.Store(time.Now().UnixNano())
+
+		switch msg := msg.(type) {
+		case *Ping:
+			err = c.Send(&Pong{Seq: msg.Seq})
+			if err != nil {
+				return err
+			}
+		case *Pong:
+		default:
+			if handle != nil {
+				handle(msg)
+			}
+		}
+	}
+}
+
+// Run 读取控制消息并且每隔 interval 发送 Ping，超过 timeout 没有收到任何消息返回 ErrKeepaliveTimeout。
+// interval 不大于 0 时不发送 Ping。返回前会关闭流
+func (c *ControlStream) Run(interval time.Duration, timeout time.Duration, handle func(Message)) error {
+	defer c.Close()
+
+	c.lastRecv.Store(time.Now().UnixNano())
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- c.readMessages(handle)
+	}()
+
+	if interval <= 0 {
+		return <-readErr
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var seq uint64
+	for {
+		select {
+		case err := <-readErr:
+			return err
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, c.lastRecv.Load())) > timeout {
+				return ErrKeepaliveTimeout
+			}
+			seq++
+			err := c.Send(&Ping{Seq: seq})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func NewControlStream(rw io.ReadWriteCloser) *ControlStream {
+	return &ControlStream{
+		rw: rw,
+	}
+}
+
+func init() {
+	Register(MsgOpenStream, func() Message { return new(OpenStream) })
+	Register(MsgPing, func() Message { return new(Ping) })
+	Register(MsgPong, func() Message { return new(Pong) })
+	Register(MsgRevoked, func() Message { return new(Revoked) })
+	Register(MsgOpenStreamOk, func() Message { return new(OpenStreamOk) })
+	Register(MsgStreamMetadata, func() Message { return new(StreamMetadata) })
+}
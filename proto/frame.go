@@ -0,0 +1,153 @@
+package proto
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// FrameMagic 是 v2 连接发送的第一个字节，v1 连接的第一个字节是命令，不会与之冲突
+const FrameMagic = 0xf2
+
+// LinkUpgrade 是在 API 端口上建立 link 时 HTTP Upgrade 头的值，升级后的连接与 link 端口上的连接相同
+const LinkUpgrade = "ksrp-link"
+
+// v2 帧格式: type(uvarint) | length(uvarint) | payload(JSON)
+const (
+	maxFramePayload = 64 * 1024
+)
+
+var (
+	ErrFrameTooLarge  = errors.New("frame too large")
+	ErrUnknownMessage = errors.New("unknown message type")
+)
+
+type MessageType uint64
+
+const (
+	MsgError   MessageType = 1
+	MsgHello   MessageType = 2
+	MsgHelloOk MessageType = 3
+)
+
+type Message interface {
+	Type() MessageType
+}
+
+var (
+	registry     = make(map[MessageType]func() Message)
+	registryLock sync.RWMutex
+)
+
+// Register 注册消息类型，ReadFrame 根据类型创建消息
+func Register(typ MessageType, newMessage func() Message) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[typ]; ok {
+		panic(fmt.Sprintf("proto: message type %d already registered", typ))
+	}
+	registry[typ] = newMessage
+}
+
+func lookupMessage(typ MessageType) func() Message {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return registry[typ]
+}
+
+// byteReader 逐字节读取，避免从 conn 中预读超过一帧的数据
+type byteReader struct {
+	r io.Reader
+}
+
+func (br byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(br.r, b[:])
+	return b[0], err
+}
+
+// ReadFrame 读取一帧并解码为已注册的消息，未注册的类型会返回 ErrUnknownMessage，但帧已经被完整读取
+func ReadFrame(r io.Reader) (Message, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = byteReader{r: r}
+	}
+	typ, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	length, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxFramePayload {
+		return nil, ErrFrameTooLarge
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	newMessage := lookupMessage(MessageType(typ))
+	if newMessage == nil {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownMessage, typ)
+	}
+	msg := newMessage()
+	if len(payload) != 0 {
+		err = json.Unmarshal(payload, msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+func WriteFrame(w io.Writer, msg Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxFramePayload {
+		return ErrFrameTooLarge
+	}
+	buf := make([]byte, 0, 2*binary.MaxVarintLen64+len(payload))
+	buf = binary.AppendUvarint(buf, uint64(msg.Type()))
+	buf = binary.AppendUvarint(buf, uint64(len(payload)))
+	buf = append(buf, payload...)
+	_, err = w.Write(buf)
+	return err
+}
+
+const (
+	// ErrCodeNotAllowed 表示请求被 expose 的策略拒绝
+	ErrCodeNotAllowed = "not-allowed"
+	// ErrCodeBusy 表示 expose 达到了并发上限
+	ErrCodeBusy = "busy"
+)
+
+// Error 是 v2 的错误消息
+type Error struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+func (*Error) Type() MessageType {
+	return MsgError
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func init() {
+	Register(MsgError, func() Message { return new(Error) })
+	Register(MsgHello, func() Message { return new(Hello) })
+	Register(MsgHelloOk, func() Message { return new(HelloOk) })
+}
@@ -0,0 +1,120 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// onlyReader 隐藏 io.ByteReader，和 net.Conn 一样逐字节读取帧头
+type onlyReader struct {
+	r io.Reader
+}
+
+func (r onlyReader) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+func appendRawFrame(buf []byte, typ uint64, length uint64, payload string) []byte {
+	buf = binary.AppendUvarint(buf, typ)
+	buf = binary.AppendUvarint(buf, length)
+	return append(buf, payload...)
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	msgs := []Message{
+		&Hello{Version: ProtocolVersion, BinaryVersion: "v1.2.3", Capabilities: NewCapabilities(CapKeepalive, CapDial), Token: "token"},
+		&HelloOk{Hello: Hello{Version: 1, BinaryVersion: "dev"}},
+		&Error{Code: ErrCodeBusy, Message: "busy"},
+		&Ping{Seq: 42},
+		&Revoked{Reason: "revoked", By: "admin"},
+	}
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		err := WriteFrame(&buf, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, r := range []io.Reader{bytes.NewReader(buf.Bytes()), onlyReader{bytes.NewReader(buf.Bytes())}} {
+		for _, want := range msgs {
+			got, err := ReadFrame(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %#v, want %#v", got, want)
+			}
+		}
+		_, err := ReadFrame(r)
+		if err != io.EOF {
+			t.Fatalf("read after last frame: %v", err)
+		}
+	}
+}
+
+func TestReadFrameUnknownType(t *testing.T) {
+	buf := appendRawFrame(nil, 1000, 2, "{}")
+	var next bytes.Buffer
+	err := WriteFrame(&next, &Hello{Version: ProtocolVersion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := onlyReader{io.MultiReader(bytes.NewReader(buf), &next)}
+
+	_, err = ReadFrame(r)
+	if !errors.Is(err, ErrUnknownMessage) {
+		t.Fatalf("unknown type: %v", err)
+	}
+	// 未知类型的帧被完整读取，可以继续读取下一帧
+	msg, err := ReadFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*Hello); !ok {
+		t.Fatalf("unexpected message %#v", msg)
+	}
+}
+
+func TestReadFrameInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"oversized", appendRawFrame(nil, uint64(MsgHello), maxFramePayload+1, ""), ErrFrameTooLarge},
+		{"huge length", appendRawFrame(nil, uint64(MsgHello), 1<<62, ""), ErrFrameTooLarge},
+		{"truncated payload", appendRawFrame(nil, uint64(MsgHello), 10, `{"ve`), io.ErrUnexpectedEOF},
+		{"truncated header", binary.AppendUvarint(nil, uint64(MsgHello)), io.EOF},
+		{"truncated varint", []byte{0x80}, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadFrame(onlyReader{bytes.NewReader(tt.data)})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	_, err := ReadFrame(bytes.NewReader(appendRawFrame(nil, uint64(MsgHello), 5, "{bad}")))
+	if err == nil {
+		t.Fatal("bad payload is accepted")
+	}
+}
+
+func TestWriteFrameTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteFrame(&buf, &Error{Message: strings.Repeat("x", maxFramePayload)})
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("wrote %d bytes", buf.Len())
+	}
+}
@@ -0,0 +1,87 @@
+package proto
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	// ProtocolVersion 是当前的协议版本，使用 v1 消息握手的旧版本视为版本 1
+	ProtocolVersion = 2
+	// MinProtocolVersion 是可以兼容的最低协议版本
+	MinProtocolVersion = 1
+)
+
+const (
+	CapCompression    = "compression"
+	CapDial           = "dial"
+	CapKeepalive      = "keepalive"
+	CapRevokeNotice   = "revoke-notice"
+	CapStreamMetadata = "stream-metadata"
+)
+
+// BinaryVersion 是程序版本，可以通过 -ldflags "-X github.com/vizee/ksrp/proto.BinaryVersion=xxx" 设置
+var BinaryVersion = "dev"
+
+// Capabilities 是有序的能力集合
+type Capabilities []string
+
+func (c Capabilities) Has(name string) bool {
+	return slices.Contains(c, name)
+}
+
+// Intersect 返回双方都支持的能力
+func (c Capabilities) Intersect(other Capabilities) Capabilities {
+	var caps Capabilities
+	for _, name := range c {
+		if other.Has(name) {
+			caps = append(caps, name)
+		}
+	}
+	return caps
+}
+
+func (c Capabilities) String() string {
+	return strings.Join(c, ",")
+}
+
+func NewCapabilities(names ...string) Capabilities {
+	caps := slices.Clone(names)
+	slices.Sort(caps)
+	return slices.Compact(caps)
+}
+
+type Hello struct {
+	Version       int          `json:"version"`
+	BinaryVersion string       `json:"binaryVersion"`
+	Capabilities  Capabilities `json:"capabilities,omitempty"`
+	Token         string       `json:"token,omitempty"`
+	// APIKey 用于不绑定 token 的连接认证
+	APIKey string `json:"apiKey,omitempty"`
+}
+
+func (*Hello) Type() MessageType {
+	return MsgHello
+}
+
+// HelloOk 是 expose 对 Hello 的回复，携带协商后的版本和能力
+type HelloOk struct {
+	Hello
+}
+
+func (*HelloOk) Type() MessageType {
+	return MsgHelloOk
+}
+
+// Negotiate 检查对端的版本，返回协商后的版本、能力以及对端的程序版本
+func Negotiate(local *Hello, peer *Hello) (*Hello, error) {
+	if peer.Version < MinProtocolVersion {
+		return nil, fmt.Errorf("incompatible protocol version %d (%s), requires >= %d", peer.Version, peer.BinaryVersion, MinProtocolVersion)
+	}
+	return &Hello{
+		Version:       min(local.Version, peer.Version),
+		BinaryVersion: peer.BinaryVersion,
+		Capabilities:  local.Capabilities.Intersect(peer.Capabilities),
+	}, nil
+}
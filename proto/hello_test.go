@@ -0,0 +1,37 @@
+package proto
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	local := &Hello{Version: ProtocolVersion, Capabilities: NewCapabilities(CapCompression, CapDial, CapKeepalive)}
+	tests := []struct {
+		name    string
+		peer    *Hello
+		version int
+		caps    Capabilities
+	}{
+		{"same version", &Hello{Version: ProtocolVersion, BinaryVersion: "v2", Capabilities: NewCapabilities(CapKeepalive, CapRevokeNotice, CapDial)}, ProtocolVersion, Capabilities{CapDial, CapKeepalive}},
+		{"newer peer", &Hello{Version: ProtocolVersion + 1, Capabilities: NewCapabilities(CapCompression)}, ProtocolVersion, Capabilities{CapCompression}},
+		// v1 的 agent 没有能力，按照 v1 的方式处理
+		{"v1 peer", &Hello{Version: 1}, 1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello, err := Negotiate(local, tt.peer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hello.Version != tt.version || !slices.Equal(hello.Capabilities, tt.caps) || hello.BinaryVersion != tt.peer.BinaryVersion {
+				t.Fatalf("unexpected result %+v", hello)
+			}
+		})
+	}
+
+	_, err := Negotiate(local, &Hello{Version: MinProtocolVersion - 1})
+	if err == nil {
+		t.Fatal("incompatible version is accepted")
+	}
+}
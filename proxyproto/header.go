@@ -0,0 +1,128 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+)
+
+const (
+	V1 = 1
+	V2 = 2
+)
+
+// v2Signature 是 PROXY v2 头的前 12 个字节
+var v2Signature = [12]byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+const (
+	v2CmdLocal = 0x20
+	v2CmdProxy = 0x21
+
+	v2FamUnspec = 0x00
+	v2FamTCP4   = 0x11
+	v2FamTCP6   = 0x21
+)
+
+// Header 是 PROXY 协议头，地址无效时表示连接来源未知
+type Header struct {
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+}
+
+// ParseVersion 解析 "v1"、"v2" 形式的版本，空字符串返回 0
+func ParseVersion(s string) (int, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case "v1", "1":
+		return V1, nil
+	case "v2", "2":
+		return V2, nil
+	default:
+		return 0, fmt.Errorf("unknown proxy protocol version %q", s)
+	}
+}
+
+// addrs 返回统一地址族后的源地址和目的地址，is4 表示都是 IPv4
+func (h *Header) addrs() (src netip.AddrPort, dst netip.AddrPort, is4 bool, ok bool) {
+	if !h.Source.IsValid() || !h.Destination.IsValid() {
+		return
+	}
+	src = netip.AddrPortFrom(h.Source.Addr().Unmap(), h.Source.Port())
+	dst = netip.AddrPortFrom(h.Destination.Addr().Unmap(), h.Destination.Port())
+	if src.Addr().Is4() && dst.Addr().Is4() {
+		return src, dst, true, true
+	}
+	// 地址族不同时都使用 IPv6
+	src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+	dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	return src, dst, false, true
+}
+
+func (h *Header) AppendV1(b []byte) []byte {
+	src, dst, is4, ok := h.addrs()
+	if !ok {
+		return append(b, "PROXY UNKNOWN\r\n"...)
+	}
+	if is4 {
+		b = append(b, "PROXY TCP4 "...)
+	} else {
+		b = append(b, "PROXY TCP6 "...)
+	}
+	b = src.Addr().AppendTo(b)
+	b = append(b, ' ')
+	b = dst.Addr().AppendTo(b)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, uint64(src.Port()), 10)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, uint64(dst.Port()), 10)
+	return append(b, "\r\n"...)
+}
+
+func (h *Header) AppendV2(b []byte) []byte {
+	b = append(b, v2Signature[:]...)
+	src, dst, is4, ok := h.addrs()
+	if !ok {
+		return append(b, v2CmdLocal, v2FamUnspec, 0, 0)
+	}
+	if is4 {
+		b = append(b, v2CmdProxy, v2FamTCP4)
+		b = binary.BigEndian.AppendUint16(b, 12)
+		b = append(b, src.Addr().AsSlice()...)
+		b = append(b, dst.Addr().AsSlice()...)
+	} else {
+		b = append(b, v2CmdProxy, v2FamTCP6)
+		b = binary.BigEndian.AppendUint16(b, 36)
+		b = append(b, src.Addr().AsSlice()...)
+		b = append(b, dst.Addr().AsSlice()...)
+	}
+	b = binary.BigEndian.AppendUint16(b, src.Port())
+	return binary.BigEndian.AppendUint16(b, dst.Port())
+}
+
+// Write 按照 version 写入协议头
+func (h *Header) Write(w io.Writer, version int) error {
+	var b []byte
+	switch version {
+	case V1:
+		b = h.AppendV1(make([]byte, 0, 108))
+	case V2:
+		b = h.AppendV2(make([]byte, 0, 52))
+	default:
+		return fmt.Errorf("unknown proxy protocol version %d", version)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// NewHeader 从 "ip:port" 形式的地址创建协议头，无法解析的地址视为未知
+func NewHeader(source string, destination string) *Header {
+	src, _ := netip.ParseAddrPort(source)
+	dst, _ := netip.ParseAddrPort(destination)
+	return &Header{
+		Source:      src,
+		Destination: dst,
+	}
+}
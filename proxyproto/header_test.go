@@ -0,0 +1,48 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		src, dst         string
+		wantSrc, wantDst string
+	}{
+		{"192.0.2.1:56324", "198.51.100.2:443", "192.0.2.1:56324", "198.51.100.2:443"},
+		{"[2001:db8::1]:56324", "[2001:db8::2]:443", "[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		// IPv4 映射地址按照 IPv4 处理，地址族不同时都使用 IPv6
+		{"[::ffff:192.0.2.1]:56324", "198.51.100.2:443", "192.0.2.1:56324", "198.51.100.2:443"},
+		{"192.0.2.1:56324", "[2001:db8::2]:443", "[::ffff:192.0.2.1]:56324", "[2001:db8::2]:443"},
+		{"pipe", "198.51.100.2:443", "", ""},
+	}
+	for _, version := range []int{V1, V2} {
+		for _, tt := range tests {
+			var buf bytes.Buffer
+			err := NewHeader(tt.src, tt.dst).Write(&buf, version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, err := ReadHeader(bufio.NewReader(&buf), version)
+			if err != nil {
+				t.Fatalf("v%d %s -> %s: %v", version, tt.src, tt.dst, err)
+			}
+			if tt.wantSrc == "" {
+				if h.Source.IsValid() || h.Destination.IsValid() {
+					t.Fatalf("v%d: unknown source is written as %v -> %v", version, h.Source, h.Destination)
+				}
+				continue
+			}
+			if h.Source.String() != tt.wantSrc || h.Destination.String() != tt.wantDst {
+				t.Fatalf("v%d: got %v -> %v, want %s -> %s", version, h.Source, h.Destination, tt.wantSrc, tt.wantDst)
+			}
+		}
+	}
+
+	err := NewHeader("", "").Write(&bytes.Buffer{}, 3)
+	if err == nil {
+		t.Fatal("unknown version is accepted")
+	}
+}
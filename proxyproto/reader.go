@@ -0,0 +1,162 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxV1Length 是 v1 头包括 CRLF 的最大长度
+	maxV1Length = 107
+	// maxV2Length 限制 v2 头中地址和 TLV 的长度
+	maxV2Length = 4096
+)
+
+var (
+	ErrNoHeader      = errors.New("proxyproto: no header")
+	ErrInvalidHeader = errors.New("proxyproto: invalid header")
+)
+
+func readV1(br *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < maxV1Length {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, ErrInvalidHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		// UNKNOWN 之后的内容需要忽略
+		return &Header{}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+	src, err1 := netip.ParseAddr(fields[2])
+	dst, err2 := netip.ParseAddr(fields[3])
+	sport, err3 := strconv.ParseUint(fields[4], 10, 16)
+	dport, err4 := strconv.ParseUint(fields[5], 10, 16)
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+	}
+	return &Header{
+		Source:      netip.AddrPortFrom(src, uint16(sport)),
+		Destination: netip.AddrPortFrom(dst, uint16(dport)),
+	}, nil
+}
+
+func readV2(br *bufio.Reader) (*Header, error) {
+	var fixed [16]byte
+	_, err := io.ReadFull(br, fixed[:])
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(fixed[:12], v2Signature[:]) || fixed[12]>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+	length := int(binary.BigEndian.Uint16(fixed[14:]))
+	if length > maxV2Length {
+		return nil, ErrInvalidHeader
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(br, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Header{}
+	if fixed[12] == v2CmdLocal {
+		return h, nil
+	}
+	if fixed[12] != v2CmdProxy {
+		return nil, ErrInvalidHeader
+	}
+	// 只解析 TCP 地址，其他地址族视为未知，TLV 被忽略
+	switch fixed[13] {
+	case v2FamTCP4:
+		if length < 12 {
+			return nil, ErrInvalidHeader
+		}
+		h.Source = netip.AddrPortFrom(netip.AddrFrom4([4]byte(payload[0:4])), binary.BigEndian.Uint16(payload[8:]))
+		h.Destination = netip.AddrPortFrom(netip.AddrFrom4([4]byte(payload[4:8])), binary.BigEndian.Uint16(payload[10:]))
+	case v2FamTCP6:
+		if length < 36 {
+			return nil, ErrInvalidHeader
+		}
+		h.Source = netip.AddrPortFrom(netip.AddrFrom16([16]byte(payload[0:16])), binary.BigEndian.Uint16(payload[32:]))
+		h.Destination = netip.AddrPortFrom(netip.AddrFrom16([16]byte(payload[16:32])), binary.BigEndian.Uint16(payload[34:]))
+	}
+	return h, nil
+}
+
+// ReadHeader 读取 PROXY 协议头，version 为 0 时同时接受 v1 和 v2
+func ReadHeader(br *bufio.Reader, version int) (*Header, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case first[0] == 'P' && version != V2:
+		return readV1(br)
+	case first[0] == v2Signature[0] && version != V1:
+		return readV2(br)
+	default:
+		return nil, ErrNoHeader
+	}
+}
+
+// Conn 是已经读取了 PROXY 协议头的连接
+type Conn struct {
+	net.Conn
+	Header *Header
+	br     *bufio.Reader
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+// ClientAddr 返回协议头中的客户端地址，来源未知时返回连接的地址
+func (c *Conn) ClientAddr() net.Addr {
+	if c.Header.Source.IsValid() {
+		return net.TCPAddrFromAddrPort(c.Header.Source)
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// Accept 在 timeout 内读取 conn 上的协议头
+func Accept(conn net.Conn, version int, timeout time.Duration) (*Conn, error) {
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	h, err := ReadHeader(br, version)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{
+		Conn:   conn,
+		Header: h,
+		br:     br,
+	}, nil
+}
@@ -0,0 +1,105 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// v2Header 按照 cmd、fam 和 payload 构造 v2 头
+func v2Header(cmd byte, fam byte, payload ...[]byte) string {
+	var body []byte
+	for _, p := range payload {
+		body = append(body, p...)
+	}
+	b := append(v2Signature[:], cmd, fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(body)))
+	return string(append(b, body...))
+}
+
+func ports(src uint16, dst uint16) []byte {
+	return binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, src), dst)
+}
+
+func TestReadHeader(t *testing.T) {
+	ip4 := []byte{192, 0, 2, 1, 198, 51, 100, 2}
+	ip6 := append(netip.MustParseAddr("2001:db8::1").AsSlice(), netip.MustParseAddr("2001:db8::2").AsSlice()...)
+	// type 0x04 是 PP2_TYPE_NOOP，0x02 是 PP2_TYPE_AUTHORITY
+	tlvs := []byte{0x04, 0x00, 0x02, 0x00, 0x00, 0x02, 0x00, 0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e'}
+
+	tests := []struct {
+		name    string
+		input   string
+		version int
+		src     string
+		dst     string
+		err     error
+	}{
+		{name: "v1 tcp4", input: "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n", src: "192.0.2.1:56324", dst: "198.51.100.2:443"},
+		{name: "v1 tcp6", input: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", src: "[2001:db8::1]:56324", dst: "[2001:db8::2]:443"},
+		{name: "v1 unknown", input: "PROXY UNKNOWN\r\n"},
+		{name: "v1 unknown with addresses", input: "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"},
+		{name: "v1 only", input: "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n", version: V1, src: "192.0.2.1:56324", dst: "198.51.100.2:443"},
+		{name: "v1 udp", input: "PROXY UDP4 192.0.2.1 198.51.100.2 56324 443\r\n", err: ErrInvalidHeader},
+		{name: "v1 missing field", input: "PROXY TCP4 192.0.2.1 198.51.100.2 56324\r\n", err: ErrInvalidHeader},
+		{name: "v1 bad address", input: "PROXY TCP4 192.0.2.300 198.51.100.2 56324 443\r\n", err: ErrInvalidHeader},
+		{name: "v1 bad port", input: "PROXY TCP4 192.0.2.1 198.51.100.2 65536 443\r\n", err: ErrInvalidHeader},
+		{name: "v1 bare lf", input: "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\n", err: ErrInvalidHeader},
+		{name: "v1 too long", input: "PROXY UNKNOWN " + strings.Repeat("x", maxV1Length) + "\r\n", err: ErrInvalidHeader},
+		{name: "v1 truncated", input: "PROXY TCP4 192.0.2.1", err: io.EOF},
+		{name: "v1 not proxy", input: "POST / HTTP/1.1\r\n", err: ErrInvalidHeader},
+		{name: "v1 rejected by v2", input: "PROXY UNKNOWN\r\n", version: V2, err: ErrNoHeader},
+
+		{name: "v2 tcp4", input: v2Header(v2CmdProxy, v2FamTCP4, ip4, ports(56324, 443)), src: "192.0.2.1:56324", dst: "198.51.100.2:443"},
+		{name: "v2 tcp6", input: v2Header(v2CmdProxy, v2FamTCP6, ip6, ports(56324, 443)), src: "[2001:db8::1]:56324", dst: "[2001:db8::2]:443"},
+		{name: "v2 tlvs", input: v2Header(v2CmdProxy, v2FamTCP4, ip4, ports(56324, 443), tlvs), version: V2, src: "192.0.2.1:56324", dst: "198.51.100.2:443"},
+		{name: "v2 local", input: v2Header(v2CmdLocal, v2FamUnspec)},
+		{name: "v2 local with tlvs", input: v2Header(v2CmdLocal, v2FamTCP4, ip4, ports(1, 2), tlvs)},
+		{name: "v2 unix", input: v2Header(v2CmdProxy, 0x31, make([]byte, 216))},
+		{name: "v2 short tcp4", input: v2Header(v2CmdProxy, v2FamTCP4, ip4), err: ErrInvalidHeader},
+		{name: "v2 short tcp6", input: v2Header(v2CmdProxy, v2FamTCP6, ip6), err: ErrInvalidHeader},
+		{name: "v2 bad command", input: v2Header(0x22, v2FamTCP4, ip4, ports(1, 2)), err: ErrInvalidHeader},
+		{name: "v2 bad version", input: v2Header(0x11, v2FamTCP4, ip4, ports(1, 2)), err: ErrInvalidHeader},
+		{name: "v2 bad signature", input: "\r\n\r\n\x00\r\nQUIX\n\x21\x11\x00\x0c" + string(ip4) + string(ports(1, 2)), err: ErrInvalidHeader},
+		{name: "v2 too long", input: v2Header(v2CmdProxy, v2FamTCP4, make([]byte, maxV2Length+1)), err: ErrInvalidHeader},
+		{name: "v2 truncated signature", input: string(v2Signature[:8]), err: io.ErrUnexpectedEOF},
+		{name: "v2 truncated payload", input: v2Header(v2CmdProxy, v2FamTCP4, ip4, ports(1, 2))[:20], err: io.ErrUnexpectedEOF},
+		{name: "v2 rejected by v1", input: v2Header(v2CmdLocal, v2FamUnspec), version: V1, err: ErrNoHeader},
+		{name: "no header", input: "GET / HTTP/1.1\r\n\r\n", err: ErrNoHeader},
+		{name: "empty", input: "", err: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 协议头之后的数据需要保留
+			br := bufio.NewReader(strings.NewReader(tt.input + "data"))
+			if tt.err != nil {
+				br = bufio.NewReader(strings.NewReader(tt.input))
+			}
+			h, err := ReadHeader(br, tt.version)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.src == "" {
+				if h.Source.IsValid() || h.Destination.IsValid() {
+					t.Fatalf("unexpected addresses %v -> %v", h.Source, h.Destination)
+				}
+			} else if h.Source.String() != tt.src || h.Destination.String() != tt.dst {
+				t.Fatalf("got %v -> %v, want %s -> %s", h.Source, h.Destination, tt.src, tt.dst)
+			}
+			rest, _ := io.ReadAll(br)
+			if string(rest) != "data" {
+				t.Fatalf("data after header: %q", rest)
+			}
+		})
+	}
+}